@@ -0,0 +1,356 @@
+// Package elasticsearch implements an output that indexes events with the Elasticsearch
+// bulk API, for environments without Logstash.
+//
+// Documents are created with IDs derived from the journal cursor of their event, so
+// events sent again after a restart or a failed request are reported by Elasticsearch
+// as conflicts instead of being indexed twice.
+package elasticsearch
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/httpoutput"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DefaultIndex writes to a daily index.
+	DefaultIndex = "journal-%{+2006.01.02}"
+
+	defaultBatchMaxEvents = 500
+	defaultBatchMaxBytes  = 5 << 20
+)
+
+// indexDate matches the "%{+layout}" placeholders in index names.
+var indexDate = regexp.MustCompile(`%\{\+([^}]+)\}`)
+
+// Config holds the settings for an Elasticsearch Client.
+type Config struct {
+	// URLs are the base URLs of Elasticsearch nodes, such as https://es:9200. Bulk
+	// requests go to the first node, moving on to the next after a failure.
+	URLs []string
+	// Index is the name of the index documents are written to. Each "%{+layout}" in it
+	// is replaced by the event's timestamp formatted with the Go time layout, so the
+	// default, "journal-%{+2006.01.02}", writes to a daily index.
+	Index string
+	// Pipeline is the optional ingest pipeline documents are passed through.
+	Pipeline string
+	// Username and Password authenticate with HTTP basic auth. APIKey, the base64
+	// encoding of "id:api_key", authenticates with an API key instead.
+	Username string
+	Password string
+	APIKey   string
+	// TLSConfig is used for https URLs, or Go's defaults if nil.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// BatchMaxEvents and BatchMaxBytes limit the size of a bulk request.
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	// RetryMaxElapsed is how long a bulk request is retried before Flush gives up. A
+	// negative value retries for ever.
+	RetryMaxElapsed time.Duration
+}
+
+// Client indexes Logstash V1Events into Elasticsearch.
+//
+// Write adds events to a bulk request, which is sent once it is full. Flush sends a
+// partially filled bulk request. A request is retried until every document in it has
+// been created, has been found to exist already, or has been rejected by Elasticsearch
+// for a reason that retrying can't fix, such as a mapping conflict.
+type Client struct {
+	Config
+	sender       *httpoutput.Sender
+	node         int
+	pending      []*document
+	pendingBytes int
+	lastErr      error
+	clientMetrics
+}
+
+// document is a bulk action line and the document source that follows it.
+type document struct {
+	action []byte
+	source []byte
+}
+
+func (d *document) size() int {
+	return len(d.action) + len(d.source) + 2
+}
+
+type clientMetrics struct {
+	bulkRequests metrics.Counter
+	throttled    metrics.Counter
+	created      metrics.Counter
+	duplicates   metrics.Counter
+	rejected     metrics.Counter
+	retried      metrics.Counter
+}
+
+// NewClient returns a Client object. Open checks that Elasticsearch can be reached.
+func NewClient(cfg Config) (*Client, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("at least one elasticsearch URL is required")
+	}
+	// trimmed below, without changing the caller's slice
+	cfg.URLs = append([]string(nil), cfg.URLs...)
+	for i, u := range cfg.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("elasticsearch URL must start with http:// or https://: %s", u)
+		}
+		cfg.URLs[i] = strings.TrimRight(u, "/")
+	}
+	if cfg.APIKey != "" && cfg.Username != "" {
+		return nil, errors.New("an elasticsearch API key cannot be combined with a username and password")
+	}
+	if cfg.Index == "" {
+		cfg.Index = DefaultIndex
+	}
+	if cfg.BatchMaxEvents == 0 {
+		cfg.BatchMaxEvents = defaultBatchMaxEvents
+	}
+	if cfg.BatchMaxBytes == 0 {
+		cfg.BatchMaxBytes = defaultBatchMaxBytes
+	}
+
+	c := &Client{
+		Config: cfg,
+		sender: httpoutput.NewSender(httpoutput.Config{
+			Name:        "elasticsearch",
+			TLSConfig:   cfg.TLSConfig,
+			Timeout:     cfg.Timeout,
+			RetryPolicy: logstash.RetryPolicy{MaxElapsed: cfg.RetryMaxElapsed},
+		}),
+		clientMetrics: clientMetrics{
+			bulkRequests: metrics.GetOrRegisterCounter("elasticsearch_bulk_requests", metrics.DefaultRegistry),
+			throttled:    metrics.GetOrRegisterCounter("elasticsearch_throttled", metrics.DefaultRegistry),
+			created:      metrics.GetOrRegisterCounter("elasticsearch_docs_created", metrics.DefaultRegistry),
+			duplicates:   metrics.GetOrRegisterCounter("elasticsearch_docs_duplicate", metrics.DefaultRegistry),
+			rejected:     metrics.GetOrRegisterCounter("elasticsearch_docs_rejected", metrics.DefaultRegistry),
+			retried:      metrics.GetOrRegisterCounter("elasticsearch_docs_retried", metrics.DefaultRegistry),
+		},
+	}
+	return c, nil
+}
+
+// Open checks that an Elasticsearch node can be reached with the configured
+// credentials, retrying according to RetryMaxElapsed. Credentials that may only index
+// documents are refused the cluster's info, which still proves they are valid.
+func (c *Client) Open() error {
+	return c.sender.Retry(func() error {
+		req, err := http.NewRequest("GET", c.URLs[c.node]+"/", nil)
+		if err != nil {
+			return err
+		}
+		resp, err := c.send(req)
+		var status *httpoutput.StatusError
+		if errors.As(err, &status) && status.Status == http.StatusForbidden {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(ioutil.Discard, resp.Body)
+		return nil
+	}, c.nextNode)
+}
+
+// Write adds an event to the current bulk request, and sends the request if it is
+// full. If sending fails the event is removed from the request again, so that the
+// caller may retry the Write.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	doc, err := c.encode(e)
+	if err != nil {
+		return 0, err
+	}
+	c.pending = append(c.pending, doc)
+	c.pendingBytes += doc.size()
+	if len(c.pending) >= c.BatchMaxEvents || c.pendingBytes >= c.BatchMaxBytes {
+		if err := c.Flush(); err != nil {
+			if n := len(c.pending); n > 0 && c.pending[n-1] == doc {
+				c.pending = c.pending[:n-1]
+				c.pendingBytes -= doc.size()
+			}
+			return 0, err
+		}
+	}
+	return len(doc.source), nil
+}
+
+// Flush sends the current bulk request and blocks until every document in it has been
+// handled.
+func (c *Client) Flush() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	err := c.sender.Retry(c.bulk, c.nextNode)
+	c.lastErr = err
+	return err
+}
+
+// Close discards any events that have not been sent.
+func (c *Client) Close() error {
+	c.pending = nil
+	c.pendingBytes = 0
+	return nil
+}
+
+// Health returns the error of the last bulk request that failed for good, if the
+// request since hasn't succeeded.
+func (c *Client) Health() error {
+	return c.lastErr
+}
+
+// encode returns the bulk action and source for an event.
+func (c *Client) encode(e *logstash.V1Event) (*document, error) {
+	source, err := e.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	meta := map[string]string{"_index": indexName(c.Index, e.Timestamp)}
+	if id := documentID(e); id != "" {
+		meta["_id"] = id
+	}
+	action, err := json.Marshal(map[string]map[string]string{"create": meta})
+	if err != nil {
+		return nil, err
+	}
+	return &document{action: action, source: source}, nil
+}
+
+// indexName expands the "%{+layout}" placeholders in index with t.
+func indexName(index string, t time.Time) string {
+	return indexDate.ReplaceAllStringFunc(index, func(placeholder string) string {
+		return t.UTC().Format(indexDate.FindStringSubmatch(placeholder)[1])
+	})
+}
+
+// documentID returns an ID derived from the event's journal cursor, or "" if the event
+// has none and Elasticsearch should choose one.
+func documentID(e *logstash.V1Event) string {
+	cursor := e.Fields["__CURSOR"]
+	if cursor == "" {
+		return ""
+	}
+	hash := sha256.Sum256([]byte(cursor))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// nextNode moves on to the next node after a failed request.
+func (c *Client) nextNode(error) {
+	c.node = (c.node + 1) % len(c.URLs)
+}
+
+// send sends req with the configured credentials. Unsuccessful responses are returned
+// as a *httpoutput.StatusError.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	if c.APIKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.APIKey)
+	} else if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.sender.Do(req)
+	var status *httpoutput.StatusError
+	if errors.As(err, &status) && status.Status == http.StatusTooManyRequests {
+		c.throttled.Inc(1)
+	}
+	return resp, err
+}
+
+type bulkResponse struct {
+	Errors bool                        `json:"errors"`
+	Items  []map[string]bulkItemResult `json:"items"`
+}
+
+type bulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// bulk sends the pending documents in one bulk request. Documents that were created,
+// already existed or were rejected for good are removed from the pending ones; if any
+// remain, because Elasticsearch was too busy for them, an error is returned so that
+// they are retried. A response that can't be decoded, or doesn't have an item for each
+// document, is a *httpoutput.ProtocolError, which is not retried.
+func (c *Client) bulk() error {
+	var body bytes.Buffer
+	for _, doc := range c.pending {
+		body.Write(doc.action)
+		body.WriteByte('\n')
+		body.Write(doc.source)
+		body.WriteByte('\n')
+	}
+	u := c.URLs[c.node] + "/_bulk"
+	if c.Pipeline != "" {
+		u += "?pipeline=" + url.QueryEscape(c.Pipeline)
+	}
+	req, err := http.NewRequest("POST", u, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	c.bulkRequests.Inc(1)
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result bulkResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return &httpoutput.ProtocolError{Name: "elasticsearch", Err: fmt.Errorf("decoding bulk response: %s", err)}
+	}
+	if len(result.Items) != len(c.pending) {
+		return &httpoutput.ProtocolError{Name: "elasticsearch",
+			Err: fmt.Errorf("bulk response has %d items but %d documents were sent", len(result.Items), len(c.pending))}
+	}
+
+	remaining := c.pending[:0]
+	remainingBytes := 0
+	for i, item := range result.Items {
+		doc := c.pending[i]
+		// each item is keyed by its action, "create"
+		var r bulkItemResult
+		for _, result := range item {
+			r = result
+		}
+		switch {
+		case r.Status < 300:
+			c.created.Inc(1)
+		case r.Status == http.StatusConflict:
+			c.duplicates.Inc(1)
+		case r.Status == http.StatusTooManyRequests || r.Status >= 500:
+			c.retried.Inc(1)
+			remaining = append(remaining, doc)
+			remainingBytes += doc.size()
+		default:
+			c.rejected.Inc(1)
+			log.Printf("Elasticsearch rejected document %s: %d %s", doc.action, r.Status, r.Error)
+		}
+	}
+	c.pending = remaining
+	c.pendingBytes = remainingBytes
+	if len(c.pending) > 0 {
+		return fmt.Errorf("%d documents were not accepted", len(c.pending))
+	}
+	return nil
+}
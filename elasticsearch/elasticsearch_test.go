@@ -0,0 +1,243 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/httpoutput"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+// esServer is a minimal Elasticsearch stand-in. It creates documents from bulk
+// requests, answering 409 for IDs it already has. The first throttleRequests bulk
+// requests are answered 429, the first throttleItems documents get a 429 item, and
+// documents whose message is "reject" get a 400 item. If malformed is set, bulk
+// responses are cut short.
+type esServer struct {
+	*httptest.Server
+	throttleRequests int
+	throttleItems    int
+	malformed        bool
+
+	sync.Mutex
+	docs     map[string]map[string]interface{} // by index/_id
+	bulks    int
+	lastBulk *http.Request
+}
+
+func newESServer() *esServer {
+	s := &esServer{docs: map[string]map[string]interface{}{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *esServer) handle(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	if r.Header.Get("Authorization") == "ApiKey wrong" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path != "/_bulk" {
+		fmt.Fprint(w, `{"version":{"number":"8.0.0"}}`)
+		return
+	}
+	s.bulks++
+	s.lastBulk = r
+	if s.throttleRequests > 0 {
+		s.throttleRequests--
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	if s.malformed {
+		fmt.Fprint(w, `{"errors": false, "items": [`)
+		return
+	}
+
+	items := []map[string]map[string]interface{}{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var action map[string]map[string]string
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		var source map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &source)
+
+		key := action["create"]["_index"] + "/" + action["create"]["_id"]
+		status := http.StatusCreated
+		switch {
+		case s.throttleItems > 0:
+			s.throttleItems--
+			status = http.StatusTooManyRequests
+		case source["message"] == "reject":
+			status = http.StatusBadRequest
+		case s.docs[key] != nil:
+			status = http.StatusConflict
+		default:
+			s.docs[key] = source
+		}
+		items = append(items, map[string]map[string]interface{}{"create": {"status": status}})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+}
+
+func (s *esServer) Docs() map[string]map[string]interface{} {
+	s.Lock()
+	defer s.Unlock()
+	docs := map[string]map[string]interface{}{}
+	for k, v := range s.docs {
+		docs[k] = v
+	}
+	return docs
+}
+
+func event(message, cursor string) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+	e.Message = message
+	if cursor != "" {
+		e.Fields["__CURSOR"] = cursor
+	}
+	return e
+}
+
+func newTestClient(t *testing.T, s *esServer, cfg Config) *Client {
+	cfg.URLs = []string{s.URL}
+	if cfg.RetryMaxElapsed == 0 {
+		cfg.RetryMaxElapsed = time.Duration(5 * time.Second)
+	}
+	c, err := NewClient(cfg)
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+	return c
+}
+
+func TestWrite(t *testing.T) {
+	s := newESServer()
+	defer s.Close()
+	c := newTestClient(t, s, Config{BatchMaxEvents: 2, Pipeline: "journal", Username: "shipper", Password: "secret"})
+
+	_, err := c.Write(event("one", "s=1"))
+	assert.Nil(t, err)
+	assert.Empty(t, s.Docs(), "a batch is only sent once it is full")
+	_, err = c.Write(event("two", "s=2"))
+	assert.Nil(t, err)
+	_, err = c.Write(event("three", ""))
+	assert.Nil(t, err)
+	assert.Nil(t, c.Flush())
+
+	docs := s.Docs()
+	assert.Len(t, docs, 3)
+	assert.Equal(t, "one", docs["journal-2016.08.10/"+documentID(event("one", "s=1"))]["message"])
+	assert.Equal(t, "three", docs["journal-2016.08.10/"]["message"], "events without a cursor get no _id")
+	assert.Equal(t, 2, s.bulks)
+	assert.Equal(t, "journal", s.lastBulk.URL.Query().Get("pipeline"))
+	assert.Equal(t, "application/x-ndjson", s.lastBulk.Header.Get("Content-Type"))
+	user, password, _ := s.lastBulk.BasicAuth()
+	assert.Equal(t, "shipper", user)
+	assert.Equal(t, "secret", password)
+	assert.Nil(t, c.Health())
+}
+
+func TestFlush__duplicates(t *testing.T) {
+	s := newESServer()
+	defer s.Close()
+	c := newTestClient(t, s, Config{})
+	duplicates := c.duplicates.Count()
+
+	for i := 0; i < 2; i++ {
+		c.Write(event("one", "s=1"))
+		c.Write(event("two", "s=2"))
+		assert.Nil(t, c.Flush())
+	}
+	assert.Len(t, s.Docs(), 2)
+	assert.Equal(t, int64(2), c.duplicates.Count()-duplicates)
+}
+
+func TestFlush__backpressure(t *testing.T) {
+	s := newESServer()
+	defer s.Close()
+	s.throttleRequests = 1
+	s.throttleItems = 1
+	c := newTestClient(t, s, Config{})
+
+	c.Write(event("one", "s=1"))
+	c.Write(event("two", "s=2"))
+	assert.Nil(t, c.Flush())
+	assert.Len(t, s.Docs(), 2)
+	// the throttled request, the request where "one" was throttled, and its retry
+	assert.Equal(t, 3, s.bulks)
+	assert.Equal(t, 1, strings.Count(fmt.Sprint(s.Docs()), "one"))
+}
+
+func TestFlush__rejected(t *testing.T) {
+	s := newESServer()
+	defer s.Close()
+	c := newTestClient(t, s, Config{})
+
+	c.Write(event("reject", "s=1"))
+	c.Write(event("two", "s=2"))
+	assert.Nil(t, c.Flush())
+	assert.Len(t, s.Docs(), 1)
+	assert.Equal(t, 1, s.bulks, "rejected documents are not retried")
+}
+
+func TestFlush__protocolError(t *testing.T) {
+	s := newESServer()
+	defer s.Close()
+	s.malformed = true
+	c := newTestClient(t, s, Config{})
+
+	c.Write(event("one", "s=1"))
+	err := c.Flush()
+	var protocol *httpoutput.ProtocolError
+	assert.True(t, errors.As(err, &protocol))
+	assert.Equal(t, 1, s.bulks, "responses that can't be decoded are not retried")
+	assert.Equal(t, 1, len(c.pending))
+	assert.NotNil(t, c.Health())
+}
+
+func TestOpen__unauthorized(t *testing.T) {
+	s := newESServer()
+	defer s.Close()
+	c, err := NewClient(Config{URLs: []string{s.URL}, APIKey: "wrong"})
+	assert.Nil(t, err)
+
+	start := time.Now()
+	err = c.Open()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "401")
+	assert.True(t, time.Since(start) < time.Second, "authentication errors are not retried")
+}
+
+func TestNewClient(t *testing.T) {
+	urls := []string{"https://es1:9200/", "https://es2:9200"}
+	c, err := NewClient(Config{URLs: urls})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"https://es1:9200", "https://es2:9200"}, c.URLs)
+	assert.Equal(t, "https://es1:9200/", urls[0], "the caller's URLs are left as they are")
+
+	_, err = NewClient(Config{URLs: []string{"es:9200"}})
+	assert.NotNil(t, err)
+
+	_, err = NewClient(Config{URLs: []string{"https://es:9200"}, APIKey: "a2V5", Username: "shipper"})
+	assert.NotNil(t, err)
+}
+
+func TestIndexName(t *testing.T) {
+	ts := time.Date(2016, 8, 10, 23, 0, 0, 0, time.FixedZone("EST", -5*3600))
+	assert.Equal(t, "journal-2016.08.11", indexName(DefaultIndex, ts))
+	assert.Equal(t, "logs-2016-08-host", indexName("logs-%{+2006}-%{+01}-host", ts))
+	assert.Equal(t, "static", indexName("static", ts))
+}
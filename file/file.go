@@ -0,0 +1,251 @@
+// Package file implements an output that writes events to a local file as the
+// Logstash V1 JSON lines the network outputs would ship.
+//
+// The file is rotated when it would grow beyond MaxBytes or has been written to for
+// RotateInterval. A rotated file is renamed with the time of its rotation, such as
+// events.json.20160810T120000.000000000Z, and gzip compressed. Rotated files beyond
+// MaxFiles, or older than MaxAge, are deleted.
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	rotatedTimeFormat = "20060102T150405.000000000Z"
+	compressedSuffix  = ".gz"
+)
+
+// now is replaced in tests.
+var now = time.Now
+
+// Config holds the settings for a File.
+type Config struct {
+	// Path is the file events are written to. Rotated files are kept beside it.
+	Path string
+	// MaxBytes is the size a file may grow to before it is rotated. 0 disables
+	// rotation by size.
+	MaxBytes int64
+	// RotateInterval is how long a file is written to before it is rotated. 0 disables
+	// rotation by time.
+	RotateInterval time.Duration
+	// Compress gzips rotated files.
+	Compress bool
+	// MaxFiles is the number of rotated files kept. 0 keeps every file.
+	MaxFiles int
+	// MaxAge is how long rotated files are kept. 0 keeps files regardless of age.
+	MaxAge time.Duration
+}
+
+// File is an output.Output that appends events to a local file.
+//
+// Write buffers events in memory. Flush writes them to the file and syncs it to disk,
+// so once Flush returns the shipper may advance the journal cursor past them.
+type File struct {
+	Config
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	opened  time.Time
+	lastErr error
+	fileMetrics
+}
+
+type fileMetrics struct {
+	written  metrics.Counter
+	rotated  metrics.Counter
+	bytesOut metrics.Counter
+}
+
+// New returns a File. The file is created or opened for appending by Open.
+func New(cfg Config) (*File, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("a file path is required")
+	}
+	if cfg.MaxBytes < 0 || cfg.RotateInterval < 0 || cfg.MaxFiles < 0 || cfg.MaxAge < 0 {
+		return nil, errors.New("file rotation and retention settings must not be negative")
+	}
+	f := &File{
+		Config: cfg,
+		fileMetrics: fileMetrics{
+			written:  metrics.GetOrRegisterCounter("file_events_written", metrics.DefaultRegistry),
+			rotated:  metrics.GetOrRegisterCounter("file_rotations", metrics.DefaultRegistry),
+			bytesOut: metrics.GetOrRegisterCounter("file_bytes_written", metrics.DefaultRegistry),
+		},
+	}
+	return f, nil
+}
+
+// Open opens the file for appending, creating it and its directory if needed.
+func (f *File) Open() error {
+	if f.f != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.f = file
+	f.w = bufio.NewWriter(file)
+	f.size = info.Size()
+	f.opened = now()
+	return nil
+}
+
+// Write appends an event to the file as a JSON line, rotating the file first if the
+// line would take it over MaxBytes or RotateInterval has passed.
+func (f *File) Write(e *logstash.V1Event) (int, error) {
+	if err := f.Open(); err != nil {
+		f.lastErr = err
+		return 0, err
+	}
+	b, err := e.ToJSON()
+	if err != nil {
+		return 0, err
+	}
+	b = append(b, '\n')
+
+	full := f.MaxBytes > 0 && f.size > 0 && f.size+int64(len(b)) > f.MaxBytes
+	old := f.RotateInterval > 0 && now().Sub(f.opened) >= f.RotateInterval
+	if full || old {
+		if err := f.rotate(); err != nil {
+			f.lastErr = err
+			return 0, err
+		}
+	}
+
+	if _, err := f.w.Write(b); err != nil {
+		f.lastErr = err
+		return 0, err
+	}
+	f.size += int64(len(b))
+	f.written.Inc(1)
+	f.bytesOut.Inc(int64(len(b)))
+	return len(b), nil
+}
+
+// Flush writes buffered events to the file and syncs it to disk.
+func (f *File) Flush() error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.w.Flush()
+	if err == nil {
+		err = f.f.Sync()
+	}
+	f.lastErr = err
+	return err
+}
+
+// Close flushes and closes the file.
+func (f *File) Close() error {
+	if f.f == nil {
+		return nil
+	}
+	err := f.Flush()
+	if cerr := f.f.Close(); err == nil {
+		err = cerr
+	}
+	f.f = nil
+	f.w = nil
+	return err
+}
+
+// Health returns the last error writing to the file, until a Flush succeeds.
+func (f *File) Health() error {
+	return f.lastErr
+}
+
+// rotate closes the current file, renames it with the time of rotation, compresses
+// it, applies retention and opens a new file.
+func (f *File) rotate() error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	rotated := f.Path + "." + now().UTC().Format(rotatedTimeFormat)
+	if err := os.Rename(f.Path, rotated); err != nil {
+		return err
+	}
+	f.rotated.Inc(1)
+	if f.Compress {
+		if err := compress(rotated); err != nil {
+			// keep the uncompressed file rather than lose events
+			log.Printf("Error compressing rotated file %s: %s", rotated, err)
+		}
+	}
+	f.prune()
+	return f.Open()
+}
+
+// compress replaces a file with a gzip compressed copy.
+func compress(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path+compressedSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+	w := gzip.NewWriter(out)
+	_, err = io.Copy(w, in)
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path + compressedSuffix)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// prune deletes the rotated files beyond MaxFiles and those older than MaxAge.
+func (f *File) prune() {
+	rotated, err := filepath.Glob(f.Path + ".2*")
+	if err != nil {
+		return
+	}
+	// the time in their names sorts the files oldest first
+	sort.Strings(rotated)
+	for i, path := range rotated {
+		name := strings.TrimSuffix(strings.TrimPrefix(path, f.Path+"."), compressedSuffix)
+		t, err := time.Parse(rotatedTimeFormat, name)
+		if err != nil {
+			continue
+		}
+		tooMany := f.MaxFiles > 0 && i < len(rotated)-f.MaxFiles
+		tooOld := f.MaxAge > 0 && now().Sub(t) > f.MaxAge
+		if tooMany || tooOld {
+			if err := os.Remove(path); err != nil {
+				log.Printf("Error removing rotated file %s: %s", path, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock replaces now for the duration of a test.
+func fakeClock(t *testing.T, start time.Time) *time.Time {
+	clock := start
+	now = func() time.Time { return clock }
+	t.Cleanup(func() { now = time.Now })
+	return &clock
+}
+
+func event(msg string) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+	e.Message = msg
+	e.Fields["_SYSTEMD_UNIT"] = "nginx.service"
+	return e
+}
+
+// readLines returns the messages of the JSON lines in a file, decompressing it if
+// it is gzipped.
+func readLines(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+	var r = bufio.NewReader(f)
+	if filepath.Ext(path) == ".gz" {
+		gz, err := gzip.NewReader(f)
+		assert.Nil(t, err)
+		r = bufio.NewReader(gz)
+	}
+	var msgs []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		var m map[string]interface{}
+		assert.Nil(t, json.Unmarshal(s.Bytes(), &m))
+		msgs = append(msgs, m["message"].(string))
+	}
+	return msgs
+}
+
+func rotatedFiles(t *testing.T, path string) []string {
+	files, err := filepath.Glob(path + ".2*")
+	assert.Nil(t, err)
+	sort.Strings(files)
+	return files
+}
+
+func TestWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "j2l-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "sub", "events.json")
+
+	f, err := New(Config{Path: path})
+	assert.Nil(t, err)
+	assert.Nil(t, f.Open())
+	_, err = f.Write(event("one"))
+	assert.Nil(t, err)
+
+	// events are buffered until Flush
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+	assert.Nil(t, f.Flush())
+	assert.Equal(t, []string{"one"}, readLines(t, path))
+
+	// reopening appends to the file
+	assert.Nil(t, f.Close())
+	f, err = New(Config{Path: path})
+	assert.Nil(t, err)
+	f.Write(event("two"))
+	assert.Nil(t, f.Close())
+	assert.Equal(t, []string{"one", "two"}, readLines(t, path))
+}
+
+func TestWrite__rotateBySize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "j2l-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.json")
+	clock := fakeClock(t, time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+
+	line, _ := event("0").ToJSON()
+	f, err := New(Config{Path: path, MaxBytes: int64(2 * (len(line) + 1)), Compress: true, MaxFiles: 2})
+	assert.Nil(t, err)
+	for _, msg := range []string{"0", "1", "2", "3", "4", "5", "6"} {
+		*clock = clock.Add(time.Second)
+		_, err := f.Write(event(msg))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, f.Close())
+
+	// two events fit in each file, and only the two newest rotated files are kept
+	rotated := rotatedFiles(t, path)
+	assert.Equal(t, []string{
+		path + ".20160810T120005.000000000Z.gz",
+		path + ".20160810T120007.000000000Z.gz",
+	}, rotated)
+	assert.Equal(t, []string{"2", "3"}, readLines(t, rotated[0]))
+	assert.Equal(t, []string{"4", "5"}, readLines(t, rotated[1]))
+	assert.Equal(t, []string{"6"}, readLines(t, path))
+}
+
+func TestWrite__rotateByTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "j2l-file")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.json")
+	clock := fakeClock(t, time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+
+	f, err := New(Config{Path: path, RotateInterval: time.Hour, MaxAge: 90 * time.Minute})
+	assert.Nil(t, err)
+	f.Write(event("first hour"))
+	*clock = clock.Add(time.Hour)
+	f.Write(event("second hour"))
+	*clock = clock.Add(time.Hour)
+	f.Write(event("third hour"))
+	assert.Nil(t, f.Close())
+	assert.Equal(t, []string{
+		path + ".20160810T130000.000000000Z",
+		path + ".20160810T140000.000000000Z",
+	}, rotatedFiles(t, path))
+
+	// a rotation more than MaxAge later prunes the first rotated file
+	f, err = New(Config{Path: path, RotateInterval: time.Hour, MaxAge: 90 * time.Minute})
+	assert.Nil(t, err)
+	f.Write(event("fourth hour"))
+	*clock = clock.Add(time.Hour)
+	f.Write(event("fifth hour"))
+	assert.Nil(t, f.Close())
+	rotated := rotatedFiles(t, path)
+	assert.Equal(t, []string{
+		path + ".20160810T140000.000000000Z",
+		path + ".20160810T150000.000000000Z",
+	}, rotated)
+	assert.Equal(t, []string{"third hour", "fourth hour"}, readLines(t, rotated[1]))
+}
+
+func TestNew__invalidConfig(t *testing.T) {
+	_, err := New(Config{})
+	assert.NotNil(t, err)
+	_, err = New(Config{Path: "events.json", MaxBytes: -1})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,305 @@
+// Package gelf implements an output that sends events to Graylog in the Graylog
+// Extended Log Format (GELF) version 1.1.
+//
+// Over TCP, optionally with TLS, each message is a JSON document terminated by a null
+// byte. Over UDP, each message is compressed and, if it is larger than one datagram,
+// split into GELF chunks. UDP delivery is not acknowledged, so messages may be lost.
+package gelf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/pantheon-systems/journal-2-logstash/netoutput"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DefaultChunkSize keeps UDP datagrams within a typical WAN MTU.
+	DefaultChunkSize = 1420
+
+	chunkHeaderLen = 12
+	maxChunks      = 128
+
+	// infoLevel is the syslog level of messages without a PRIORITY, since GELF would
+	// otherwise treat them as alerts.
+	infoLevel = 6
+
+	// dropLogInterval is the least time between logs of dropped UDP messages.
+	dropLogInterval = time.Minute
+)
+
+var (
+	chunkMagic = []byte{0x1e, 0x0f}
+	// invalidFieldChars matches characters not allowed in additional field names.
+	invalidFieldChars = regexp.MustCompile(`[^\w.\-]`)
+)
+
+// Config holds the settings for a GELF Client.
+type Config struct {
+	// URL is the host:port of the GELF input.
+	URL string
+	// Protocol is "tcp" or "udp".
+	Protocol string
+	// TLSConfig is used to connect over TCP. If it is nil the client connects over
+	// plain TCP. It is ignored for UDP.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// Compression is "gzip", "zlib" or "none", and is only used for UDP.
+	Compression string
+	// ChunkSize is the maximum size of a UDP datagram, including the chunk header.
+	ChunkSize int
+	// Host is the host of events without a _HOSTNAME field, or this machine's hostname
+	// if empty.
+	Host string
+	// Retry is how connection attempts are retried.
+	Retry logstash.RetryPolicy
+}
+
+// Client sends Logstash V1Events to a GELF input.
+//
+// Write sends each event straight away, so Flush has nothing to do. Over TCP, a failed
+// Write reconnects and sends the event again, as the retry policy allows.
+type Client struct {
+	Config
+	conn *netoutput.Conn
+	clientMetrics
+
+	// lastDropLog is when a dropped message was last logged, and unloggedDrops how
+	// many have been dropped since.
+	lastDropLog   time.Time
+	unloggedDrops int
+}
+
+type clientMetrics struct {
+	sent    metrics.Counter
+	chunks  metrics.Counter
+	dropped metrics.Counter
+}
+
+// NewClient returns a Client object. The connection to the server is established by
+// Open, or lazily by the first Write.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = "tcp"
+	}
+	if cfg.Protocol != "tcp" && cfg.Protocol != "udp" {
+		return nil, fmt.Errorf("unknown GELF protocol: %s", cfg.Protocol)
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = "gzip"
+	}
+	if cfg.Compression != "gzip" && cfg.Compression != "zlib" && cfg.Compression != "none" {
+		return nil, fmt.Errorf("unknown GELF compression: %s", cfg.Compression)
+	}
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = DefaultChunkSize
+	}
+	if cfg.ChunkSize <= chunkHeaderLen {
+		return nil, fmt.Errorf("GELF chunk size must be larger than %d bytes", chunkHeaderLen)
+	}
+	if cfg.Host == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Host = host
+	}
+	c := &Client{
+		Config: cfg,
+		conn: netoutput.New(netoutput.Config{
+			Name:        "gelf",
+			Network:     cfg.Protocol,
+			URL:         cfg.URL,
+			TLSConfig:   cfg.TLSConfig,
+			Timeout:     cfg.Timeout,
+			RetryPolicy: cfg.Retry,
+		}),
+		clientMetrics: clientMetrics{
+			sent:    metrics.GetOrRegisterCounter("gelf_messages_sent", metrics.DefaultRegistry),
+			chunks:  metrics.GetOrRegisterCounter("gelf_chunks_sent", metrics.DefaultRegistry),
+			dropped: metrics.GetOrRegisterCounter("gelf_messages_dropped", metrics.DefaultRegistry),
+		},
+	}
+	return c, nil
+}
+
+// Open connects to the server if a connection is not already established.
+func (c *Client) Open() error {
+	return c.conn.Open()
+}
+
+// Write sends an event as a GELF message. Over UDP, a message too large to send in
+// 128 chunks, or that the socket fails to send, is dropped and counted by the
+// gelf_messages_dropped metric.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	b, err := encode(e, c.Host)
+	if err != nil {
+		return 0, err
+	}
+	if c.Protocol == "udp" {
+		return len(b), c.writeUDP(b)
+	}
+	if err := c.conn.Write(append(b, 0)); err != nil {
+		return 0, err
+	}
+	c.sent.Inc(1)
+	return len(b), nil
+}
+
+// Flush does nothing, since events are sent as they are written.
+func (c *Client) Flush() error {
+	return nil
+}
+
+// Close closes an active connection to the server.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Health returns an error if the client has no connection to the server.
+func (c *Client) Health() error {
+	return c.conn.Health()
+}
+
+// writeUDP compresses a message and sends it in one datagram, or in chunks if it
+// doesn't fit.
+func (c *Client) writeUDP(b []byte) error {
+	if err := c.conn.Open(); err != nil {
+		return err
+	}
+	b, err := compress(b, c.Compression)
+	if err != nil {
+		return err
+	}
+	datagrams, err := chunk(b, c.ChunkSize)
+	if err != nil {
+		c.drop(err)
+		return nil
+	}
+	for _, d := range datagrams {
+		// errors such as ECONNREFUSED, reported by ICMP for an earlier datagram, say
+		// nothing about whether this one arrives
+		if err := c.conn.WriteOnce(d); err != nil {
+			c.drop(err)
+			return nil
+		}
+	}
+	if len(datagrams) > 1 {
+		c.chunks.Inc(int64(len(datagrams)))
+	}
+	c.sent.Inc(1)
+	return nil
+}
+
+// drop counts a UDP message that wasn't sent, logging at most once per
+// dropLogInterval so a server that is down doesn't flood the log.
+func (c *Client) drop(err error) {
+	c.dropped.Inc(1)
+	c.unloggedDrops++
+	if time.Since(c.lastDropLog) < dropLogInterval {
+		return
+	}
+	log.Printf("Dropped %d GELF message(s), most recently: %s", c.unloggedDrops, err)
+	c.lastDropLog = time.Now()
+	c.unloggedDrops = 0
+}
+
+// encode returns the GELF message for an event. MESSAGE becomes short_message, PRIORITY
+// becomes level, _HOSTNAME becomes host, defaulting to host, and every other field
+// becomes an additional field named with a leading underscore.
+func encode(e *logstash.V1Event, host string) ([]byte, error) {
+	m := map[string]interface{}{
+		"version":       "1.1",
+		"host":          host,
+		"short_message": e.Message,
+		"timestamp":     float64(e.Timestamp.UnixNano()/int64(time.Millisecond)) / 1000,
+		"level":         infoLevel,
+	}
+	if e.Message == "" {
+		// GELF inputs reject messages without a short_message
+		m["short_message"] = "-"
+	}
+	for k, v := range e.Fields {
+		switch k {
+		case "_HOSTNAME":
+			m["host"] = v
+		case "PRIORITY":
+			if level, err := strconv.Atoi(v); err == nil && level >= 0 && level <= 7 {
+				m["level"] = level
+			}
+		default:
+			name := "_" + invalidFieldChars.ReplaceAllString(k, "_")
+			if name == "_id" {
+				// reserved by Graylog
+				name = "_id_"
+			}
+			m[name] = v
+		}
+	}
+	return json.Marshal(m)
+}
+
+// compress compresses a message with gzip or zlib, or returns it as it is for "none".
+func compress(b []byte, compression string) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch compression {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	default:
+		return b, nil
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunk returns b as it is if it fits in one datagram of size bytes, and otherwise
+// splits it into GELF chunks, each starting with the chunk magic bytes, a random
+// message ID shared by the chunks, the chunk's sequence number and the chunk count.
+func chunk(b []byte, size int) ([][]byte, error) {
+	if len(b) <= size {
+		return [][]byte{b}, nil
+	}
+	payload := size - chunkHeaderLen
+	count := (len(b) + payload - 1) / payload
+	if count > maxChunks {
+		return nil, fmt.Errorf("%d bytes would need %d chunks, more than the %d allowed", len(b), count, maxChunks)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	chunks := make([][]byte, 0, count)
+	for seq := 0; seq < count; seq++ {
+		end := (seq + 1) * payload
+		if end > len(b) {
+			end = len(b)
+		}
+		c := make([]byte, 0, chunkHeaderLen+end-seq*payload)
+		c = append(c, chunkMagic...)
+		c = append(c, id...)
+		c = append(c, byte(seq), byte(count))
+		chunks = append(chunks, append(c, b[seq*payload:end]...))
+	}
+	return chunks, nil
+}
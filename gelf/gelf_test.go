@@ -0,0 +1,219 @@
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+func journalEvent() *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 123456789, time.UTC))
+	e.Message = "foo"
+	e.Fields["PRIORITY"] = "3"
+	e.Fields["_HOSTNAME"] = "web1"
+	e.Fields["_SYSTEMD_UNIT"] = "nginx.service"
+	e.Fields["__CURSOR"] = "s=1"
+	e.Fields["odd name"] = "x"
+	return e
+}
+
+func decode(t *testing.T, b []byte) map[string]interface{} {
+	m := map[string]interface{}{}
+	assert.Nil(t, json.Unmarshal(b, &m))
+	return m
+}
+
+func TestEncode(t *testing.T) {
+	b, err := encode(journalEvent(), "default-host")
+	assert.Nil(t, err)
+	m := decode(t, b)
+
+	assert.Equal(t, "1.1", m["version"])
+	assert.Equal(t, "web1", m["host"])
+	assert.Equal(t, "foo", m["short_message"])
+	assert.Equal(t, float64(3), m["level"])
+	assert.Equal(t, 1470830400.123, m["timestamp"])
+	assert.Equal(t, "nginx.service", m["__SYSTEMD_UNIT"])
+	assert.Equal(t, "s=1", m["___CURSOR"])
+	assert.Equal(t, "x", m["_odd_name"])
+	assert.NotContains(t, m, "_PRIORITY")
+	assert.NotContains(t, m, "__HOSTNAME")
+
+	e := logstash.NewV1Event()
+	b, err = encode(e, "default-host")
+	assert.Nil(t, err)
+	m = decode(t, b)
+	assert.Equal(t, "default-host", m["host"])
+	assert.Equal(t, "-", m["short_message"])
+	assert.Equal(t, float64(infoLevel), m["level"])
+}
+
+// readMessages reads null terminated messages from the first connection to l.
+func readMessages(l net.Listener, messages chan<- []byte) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		b, err := r.ReadBytes(0)
+		if err != nil {
+			return
+		}
+		messages <- b[:len(b)-1]
+	}
+}
+
+func TestWrite__tcp(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	messages := make(chan []byte, 2)
+	go readMessages(l, messages)
+
+	c, err := NewClient(Config{URL: l.Addr().String(), Timeout: time.Duration(5 * time.Second)})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+	defer c.Close()
+	_, err = c.Write(journalEvent())
+	assert.Nil(t, err)
+	_, err = c.Write(journalEvent())
+	assert.Nil(t, err)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case b := <-messages:
+			assert.Equal(t, "foo", decode(t, b)["short_message"])
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+}
+
+func TestWrite__tls(t *testing.T) {
+	serverTLSConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	assert.Nil(t, err)
+	defer l.Close()
+	messages := make(chan []byte, 1)
+	go readMessages(l, messages)
+
+	clientTLSConfig, err := logstash.NewTLSConfig("", "", "../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	// a failed handshake fails the test straight away rather than being retried
+	c, err := NewClient(Config{URL: l.Addr().String(), TLSConfig: clientTLSConfig, Timeout: time.Duration(5 * time.Second),
+		Retry: logstash.RetryPolicy{MaxAttempts: 1}})
+	assert.Nil(t, err)
+	defer c.Close()
+	_, err = c.Write(journalEvent())
+	assert.Nil(t, err)
+
+	select {
+	case b := <-messages:
+		assert.Equal(t, "web1", decode(t, b)["host"])
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+func TestWrite__udpChunked(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	c, err := NewClient(Config{URL: l.LocalAddr().String(), Protocol: "udp", ChunkSize: 64})
+	assert.Nil(t, err)
+	defer c.Close()
+	e := journalEvent()
+	// random enough not to compress into a single datagram
+	for i := 0; i < 20; i++ {
+		e.Message += time.Duration(i * 7919).String()
+	}
+	_, err = c.Write(e)
+	assert.Nil(t, err)
+
+	var chunks [][]byte
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	for count := 1; len(chunks) < count; {
+		buf := make([]byte, 64)
+		n, _, err := l.ReadFrom(buf)
+		if !assert.Nil(t, err) {
+			return
+		}
+		d := buf[:n]
+		assert.Equal(t, chunkMagic, d[:2])
+		count = int(d[11])
+		if chunks == nil {
+			chunks = make([][]byte, 0, count)
+		}
+		assert.Equal(t, len(chunks), int(d[10]), "chunks arrive in order over loopback")
+		chunks = append(chunks, d[chunkHeaderLen:])
+	}
+	assert.True(t, len(chunks) > 1)
+
+	zr, err := gzip.NewReader(bytes.NewReader(bytes.Join(chunks, nil)))
+	assert.Nil(t, err)
+	b, err := ioutil.ReadAll(zr)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Message, decode(t, b)["short_message"])
+}
+
+func TestWrite__udpRefused(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.LocalAddr().String()
+	l.Close()
+
+	c, err := NewClient(Config{URL: addr, Protocol: "udp"})
+	assert.Nil(t, err)
+	defer c.Close()
+	dropped := c.dropped.Count()
+	// the port unreachable reply to one datagram fails a later write
+	for i := 0; i < 5; i++ {
+		_, err = c.Write(journalEvent())
+		assert.Nil(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, c.dropped.Count() > dropped)
+	assert.Equal(t, int(c.dropped.Count()-dropped)-1, c.unloggedDrops, "only the first drop is logged")
+}
+
+func TestChunk(t *testing.T) {
+	chunks, err := chunk([]byte("small"), 64)
+	assert.Nil(t, err)
+	assert.Equal(t, [][]byte{[]byte("small")}, chunks)
+
+	chunks, err = chunk([]byte(strings.Repeat("x", 100)), 62)
+	assert.Nil(t, err)
+	assert.Len(t, chunks, 2)
+	assert.Equal(t, chunks[0][2:10], chunks[1][2:10], "chunks share a message ID")
+	assert.Len(t, chunks[0], 62)
+	assert.Len(t, chunks[1], chunkHeaderLen+50)
+
+	_, err = chunk(make([]byte, 129*50), 62)
+	assert.NotNil(t, err)
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient(Config{URL: "graylog:12201", Protocol: "sctp"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "graylog:12201", Compression: "lz4"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "graylog:12201", ChunkSize: 12})
+	assert.NotNil(t, err)
+}
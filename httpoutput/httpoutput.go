@@ -0,0 +1,199 @@
+// Package httpoutput holds what the outputs that send batches of events over HTTP have
+// in common: their http.Client, the handling of unsuccessful responses, and retrying
+// requests with backoff. Each output is left with the encoding of its requests and
+// the handling of its receiver's successful responses.
+package httpoutput
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+)
+
+// Config holds the settings for a Sender.
+type Config struct {
+	// Name names the receiver in errors and logs, such as "loki".
+	Name string
+	// TLSConfig is used for https URLs, or Go's defaults if nil.
+	TLSConfig *tls.Config
+	// Timeout limits each request, including reading its response. 0 disables it.
+	Timeout time.Duration
+	// RetryPolicy is how Retry spaces attempts and when it gives up.
+	RetryPolicy logstash.RetryPolicy
+	// Temporary reports whether a response with the given status may succeed if the
+	// request is repeated. By default 429 and 5xx responses are temporary.
+	Temporary func(status int) bool
+}
+
+// Sender sends the requests of an HTTP output. Connections are made, through the
+// proxy from the environment if there is one, as requests are sent. Servers are
+// verified against the host dialed, using logstash.ConfigForHost, except through a
+// proxy, where a server addressed by IP address needs TLSConfig.ServerName.
+type Sender struct {
+	Config
+	http *http.Client
+}
+
+// StatusError is an unsuccessful response.
+type StatusError struct {
+	Name   string
+	Status int
+	// Body is the start of the response body.
+	Body string
+	// RetryAfter is the wait asked for by a Retry-After header.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded %d %s: %s", e.Name, e.Status, http.StatusText(e.Status), e.Body)
+}
+
+// ProtocolError is a successful response that doesn't make sense, such as one whose
+// body can't be decoded. Repeating the request is not expected to help.
+type ProtocolError struct {
+	Name string
+	Err  error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("unexpected response from %s: %s", e.Name, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// NewSender returns a Sender.
+func NewSender(cfg Config) *Sender {
+	cfg.RetryPolicy = cfg.RetryPolicy.WithDefaults()
+	if cfg.Temporary == nil {
+		cfg.Temporary = func(status int) bool {
+			return status == http.StatusTooManyRequests || status >= 500
+		}
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: cfg.TLSConfig,
+	}
+	if cfg.TLSConfig != nil {
+		transport.DialTLSContext = dialTLS(cfg.TLSConfig)
+	}
+	client := &http.Client{Transport: transport}
+	if cfg.Timeout > 0 {
+		client.Timeout = cfg.Timeout
+	}
+	return &Sender{Config: cfg, http: client}
+}
+
+// dialTLS returns a func for http.Transport.DialTLSContext that connects with a copy of
+// cfg for the host dialed. The transport only uses it for connections not made through
+// a proxy.
+func dialTLS(cfg *tls.Config) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		dialer := &tls.Dialer{Config: logstash.ConfigForHost(cfg, host)}
+		return dialer.DialContext(ctx, network, addr)
+	}
+}
+
+// Do sends req and returns the response if its status is 2xx. The caller must close
+// its body. Any other response is returned as a *StatusError.
+func (s *Sender) Do(req *http.Request) (*http.Response, error) {
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	return nil, &StatusError{
+		Name:       s.Name,
+		Status:     resp.StatusCode,
+		Body:       strings.TrimSpace(string(body)),
+		RetryAfter: retryAfter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// Send sends req like Do and discards the body of a successful response.
+func (s *Sender) Send(req *http.Request) error {
+	resp, err := s.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// Retryable returns true for errors that may not recur if the request is repeated:
+// network errors and temporary responses, but not a *ProtocolError.
+func (s *Sender) Retryable(err error) bool {
+	var protocol *ProtocolError
+	if errors.As(err, &protocol) {
+		return false
+	}
+	var status *StatusError
+	return !errors.As(err, &status) || s.Temporary(status.Status)
+}
+
+// Retry calls op until it succeeds, returns an error that isn't Retryable, or the
+// retry policy gives up. It waits between attempts as the policy's backoff says, or
+// as long as a StatusError's RetryAfter asks if that is longer. onRetry, if not nil,
+// is called with each error before waiting, for example to move on to another
+// server.
+func (s *Sender) Retry(op func() error, onRetry func(error)) error {
+	b := s.RetryPolicy.BackOff()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !s.Retryable(err) {
+			return err
+		}
+		if s.RetryPolicy.MaxAttempts > 0 && attempt >= s.RetryPolicy.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return fmt.Errorf("giving up after %s: %w", s.RetryPolicy.MaxElapsed, err)
+		}
+		var status *StatusError
+		if errors.As(err, &status) && status.RetryAfter > next {
+			next = status.RetryAfter
+		}
+		if onRetry != nil {
+			onRetry(err)
+		}
+		log.Printf("Error sending to %s, retrying in %s: %s", s.Name, next, err)
+		time.Sleep(next)
+	}
+}
+
+// retryAfter returns the wait asked for by a Retry-After header, given in seconds or
+// as an HTTP date, or 0.
+func retryAfter(header string) time.Duration {
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil {
+		if wait := time.Until(t); wait > 0 {
+			return wait
+		}
+	}
+	return 0
+}
@@ -0,0 +1,97 @@
+package httpoutput
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDo(t *testing.T) {
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		http.Error(w, "  slow down  ", status)
+	}))
+	defer server.Close()
+	s := NewSender(Config{Name: "receiver"})
+
+	req, _ := http.NewRequest("POST", server.URL, nil)
+	assert.Nil(t, s.Send(req))
+
+	status = http.StatusTooManyRequests
+	req, _ = http.NewRequest("POST", server.URL, nil)
+	err := s.Send(req)
+	var serr *StatusError
+	assert.True(t, errors.As(err, &serr))
+	assert.Equal(t, &StatusError{Name: "receiver", Status: 429, Body: "slow down", RetryAfter: 7 * time.Second}, serr)
+	assert.Equal(t, "receiver responded 429 Too Many Requests: slow down", err.Error())
+}
+
+func TestDo__tls(t *testing.T) {
+	serverTLSConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.TLS = serverTLSConfig
+	server.StartTLS()
+	defer server.Close()
+
+	reloader, err := logstash.NewTLSReloader(logstash.TLSFiles{Ca: "../test/fixtures/certs/ca.crt"}, logstash.TLSOptions{})
+	assert.Nil(t, err)
+	s := NewSender(Config{Name: "receiver", TLSConfig: reloader.SharedConfig()})
+
+	// the server is addressed by IP, and its cert verified against that address
+	req, _ := http.NewRequest("POST", server.URL, nil)
+	assert.Nil(t, s.Send(req))
+}
+
+func TestRetryAfter(t *testing.T) {
+	assert.Equal(t, 2*time.Second, retryAfter("2"))
+	assert.Equal(t, time.Duration(0), retryAfter(""))
+	assert.Equal(t, time.Duration(0), retryAfter("-1"))
+	assert.Equal(t, time.Duration(0), retryAfter("Wed, 10 Aug 2016 12:00:00 GMT"))
+	wait := retryAfter(time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	assert.True(t, wait > 59*time.Minute && wait <= time.Hour)
+}
+
+func TestRetry(t *testing.T) {
+	s := NewSender(Config{Name: "receiver", RetryPolicy: logstash.RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: time.Millisecond,
+	}})
+
+	// network errors and temporary responses are retried until the policy gives up
+	attempts, retries := 0, 0
+	err := s.Retry(func() error {
+		attempts++
+		if attempts == 1 {
+			return errors.New("connection reset")
+		}
+		return &StatusError{Status: http.StatusServiceUnavailable}
+	}, func(error) { retries++ })
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 2, retries)
+
+	// other responses are not retried
+	attempts = 0
+	err = s.Retry(func() error {
+		attempts++
+		return &StatusError{Status: http.StatusBadRequest}
+	}, nil)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+
+	// which statuses are temporary can be changed
+	s = NewSender(Config{Temporary: func(status int) bool { return status == http.StatusBadGateway }})
+	assert.True(t, s.Retryable(errors.New("connection reset")))
+	assert.True(t, s.Retryable(&StatusError{Status: http.StatusBadGateway}))
+	assert.False(t, s.Retryable(&StatusError{Status: http.StatusInternalServerError}))
+	assert.False(t, s.Retryable(&ProtocolError{Name: "receiver", Err: errors.New("truncated")}))
+}
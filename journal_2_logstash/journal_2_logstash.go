@@ -15,39 +15,156 @@ import (
 	"github.com/cyberdelia/go-metrics-graphite"
 	"github.com/pantheon-systems/journal-2-logstash/journal"
 	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/pantheon-systems/journal-2-logstash/output"
 	"github.com/rcrowley/go-metrics"
 )
 
 var (
 	saveInterval = time.Duration(30) * time.Second // seconds  // TODO: make this configurable
+	// defaultFlushInterval is how often the output is flushed if neither FlushInterval
+	// nor LogstashBatchMaxLatency is set
+	defaultFlushInterval = time.Duration(1) * time.Second
 )
 
 type JournalShipperConfig struct {
 	Debug       bool
 	StateFile   string
 	Socket      string
-	URL         string
+	Output      string
+	URLs        []string
 	Key         string
 	Cert        string
 	Ca          string
+	Plaintext   bool
 	GraphiteURL string
 	Timeout     time.Duration
+
+	// PKCS12 is used instead of Key and Cert, and KeyPassphraseFile decrypts either
+	PKCS12            string
+	KeyPassphraseFile string
+
+	// TLSReloadInterval is how often the key, cert and CA files are checked for changes.
+	// Zero disables reloading them.
+	TLSReloadInterval time.Duration
+
+	// TLS policy, as accepted by logstash.ParseTLSOptions
+	TLSMinVersion   string
+	TLSCipherSuites []string
+	TLSServerName   string
+	TLSPinnedSPKI   []string
+
+	LogstashStrategy        string
+	LogstashEjectAfter      int
+	LogstashEjectDuration   time.Duration
+	LogstashSRV             string
+	LogstashSRVRefresh      time.Duration
+	LogstashBatchMaxEvents  int
+	LogstashBatchMaxBytes   int
+	LogstashBatchMaxLatency time.Duration
+	LogstashReconnectAge    time.Duration
+	LogstashReconnectJitter time.Duration
+	LogstashProxy           string
+	LogstashRetry           logstash.RetryPolicy
+
+	LogstashHTTPCompressionLevel int
+
+	LumberjackWindowSize       int
+	LumberjackCompressionLevel int
+
+	GELFProtocol    string
+	GELFCompression string
+	GELFChunkSize   int
+
+	SyslogFacility int
+	SyslogSDID     string
+	SyslogSDFields []string
+
+	LokiFormat          string
+	LokiLabelFields     []string
+	LokiStaticLabels    []string // name=value pairs
+	LokiTenantID        string
+	LokiUsername        string
+	LokiPassword        string
+	LokiBatchMaxEvents  int
+	LokiBatchMaxBytes   int
+	LokiRetryMaxElapsed time.Duration
+
+	SplunkToken           string
+	SplunkSourcetype      string
+	SplunkIndex           string
+	SplunkRules           []string // unit=sourcetype[@index]
+	SplunkUseAck          bool
+	SplunkChannel         string
+	SplunkAckTimeout      time.Duration
+	SplunkBatchMaxEvents  int
+	SplunkBatchMaxBytes   int
+	SplunkRetryMaxElapsed time.Duration
+
+	OTLPFormat          string
+	OTLPCompression     string
+	OTLPHeaders         []string // name=value pairs
+	OTLPBatchMaxEvents  int
+	OTLPBatchMaxBytes   int
+	OTLPRetryMaxElapsed time.Duration
+
+	ElasticsearchIndex           string
+	ElasticsearchPipeline        string
+	ElasticsearchUsername        string
+	ElasticsearchPassword        string
+	ElasticsearchAPIKey          string
+	ElasticsearchBatchMaxEvents  int
+	ElasticsearchBatchMaxBytes   int
+	ElasticsearchRetryMaxElapsed time.Duration
+
+	// UnixNetwork is logstash.NetworkUnix or logstash.NetworkUnixgram for the unix
+	// output, whose URLs are socket paths
+	UnixNetwork string
+
+	StdoutFormat string
+	// StateReadOnly loads the cursor from StateFile, if set, but never saves it
+	StateReadOnly bool
+
+	// FilePath enables the file output, alone or alongside the network output
+	FilePath           string
+	FileMaxBytes       int64
+	FileRotateInterval time.Duration
+	FileCompress       bool
+	FileMaxFiles       int
+	FileMaxAge         time.Duration
+
+	// SpoolDir enables the disk spool in front of the output when set
+	SpoolDir          string
+	SpoolMaxBytes     int64
+	SpoolSegmentBytes int64
+	SpoolOverflow     string
+
+	// QueueSize is the number of parsed events buffered between the journal reader and the output
+	QueueSize int
+
+	// FlushInterval is how often the output is flushed, so that quiet hosts don't hold
+	// events in a partially filled batch. Zero flushes as often as
+	// LogstashBatchMaxLatency allows an event to wait.
+	FlushInterval time.Duration
 }
 
 type JournalShipper struct {
 	JournalShipperConfig
 	lastStateSave time.Time
 	lastSent      time.Time
+	lastCursor    string           // cursor of the last event written to the output
 	journal       *journal.Journal // TODO: rename this to journal.Follower() ?
-	logstash      *logstash.Client
+	output        output.Output
 	journalMetrics
 }
 
 type journalMetrics struct {
-	msgsRead      metrics.Counter
-	msgsSent      metrics.Counter
-	parseFail     metrics.Counter
-	secondsBehind metrics.GaugeFloat64
+	msgsRead       metrics.Counter
+	msgsSent       metrics.Counter
+	parseFail      metrics.Counter
+	secondsBehind  metrics.GaugeFloat64
+	outputHealthy  metrics.Gauge
+	queueDepth     metrics.Gauge
+	enqueueLatency metrics.Timer
 }
 
 func NewShipper(cfg JournalShipperConfig) (*JournalShipper, error) {
@@ -72,10 +189,13 @@ func NewShipper(cfg JournalShipperConfig) (*JournalShipper, error) {
 		return nil, fmt.Errorf("Error connecting to systemd-journal-gatewayd: %s", err.Error())
 	}
 
-	// connect to logstash TLS
-	s.logstash, err = logstash.NewClient(s.URL, s.Key, s.Cert, s.Ca, s.Timeout)
+	// connect to the configured output
+	s.output, err = newOutput(cfg)
 	if err != nil {
-		return nil, fmt.Errorf("Error connecting to logstash: %s", err.Error())
+		return nil, fmt.Errorf("Error configuring %s output: %s", cfg.Output, err.Error())
+	}
+	if err := s.output.Open(); err != nil {
+		return nil, fmt.Errorf("Error connecting to %s output: %s", cfg.Output, err.Error())
 	}
 
 	// setup periodic metric logging to stderr
@@ -101,15 +221,21 @@ func NewShipper(cfg JournalShipperConfig) (*JournalShipper, error) {
 
 func newMetrics() journalMetrics {
 	m := journalMetrics{
-		msgsRead:      metrics.NewCounter(),
-		msgsSent:      metrics.NewCounter(),
-		parseFail:     metrics.NewCounter(),
-		secondsBehind: metrics.NewGaugeFloat64(),
+		msgsRead:       metrics.NewCounter(),
+		msgsSent:       metrics.NewCounter(),
+		parseFail:      metrics.NewCounter(),
+		secondsBehind:  metrics.NewGaugeFloat64(),
+		outputHealthy:  metrics.NewGauge(),
+		queueDepth:     metrics.NewGauge(),
+		enqueueLatency: metrics.NewTimer(),
 	}
 	metrics.Register("messages_read", m.msgsRead)
 	metrics.Register("messages_sent", m.msgsSent)
 	metrics.Register("message_parse_fail", m.parseFail)
 	metrics.Register("seconds_behind", m.secondsBehind)
+	metrics.Register("output_healthy", m.outputHealthy)
+	metrics.Register("queue_depth", m.queueDepth)
+	metrics.Register("enqueue_latency", m.enqueueLatency)
 	return m
 }
 
@@ -134,12 +260,16 @@ func writeStateFile(stateFile string, cursor string) error {
 	return ioutil.WriteFile(stateFile, []byte(cursor), 0644)
 }
 
-// persist the last read cursor to the state file
+// persist the cursor of the last written event to the state file
 //
 func (s *JournalShipper) saveCursor(cursor string) error {
 	if cursor == "" {
 		return nil
 	}
+	if s.StateReadOnly {
+		s.lastStateSave = time.Now()
+		return nil
+	}
 	if s.Debug {
 		log.Printf("Saving cursor to %s: %v", s.StateFile, cursor)
 	}
@@ -192,12 +322,10 @@ func logstashEventFromJournal(raw *[]byte) (*logstash.V1Event, error) {
 // timeFromJournalInt takes a timestamp (such as __REALTIME_TIMESTAMP) which is
 // formatted as microseconds since epoch and returns a golang time.Time
 //
-// NOTE: this is reduced to millisecond resolution for compatibility with Logstash
-//
 func timeFromJournalInt(t int64) time.Time {
 	secs := t / 1000000
-	ms := t % 1000000
-	return time.Unix(secs, ms).UTC()
+	usecs := t % 1000000
+	return time.Unix(secs, usecs*int64(time.Microsecond)).UTC()
 }
 
 // parseJournalValue expects an interface{} containing a field value from the journal which
@@ -218,6 +346,17 @@ func parseJournalValue(msg interface{}) (string, error) {
 	}
 }
 
+// checkOutputHealth updates the outputHealthy metric from the output's Health() and
+// logs the reason if the output reports itself unhealthy.
+func (s *JournalShipper) checkOutputHealth() {
+	if err := s.output.Health(); err != nil {
+		log.Printf("%s output is unhealthy: %s", s.Output, err)
+		s.outputHealthy.Update(0)
+		return
+	}
+	s.outputHealthy.Update(1)
+}
+
 // updateLagMetric() should be spawned in a goroutine. It will update
 // the secondsBehind metric based on the timestamp of the last-successfully
 // sent log message. This metric can be used to detect broken or stalled clients.
@@ -232,21 +371,39 @@ func (s *JournalShipper) updateLagMetric() {
 }
 
 // Run is the main loop and will run until an error occurs.
+//
+// Events read from the journal are parsed and placed on a bounded queue. A separate
+// goroutine, send(), writes them to the output so that a stalled output does not
+// stall the HTTP stream from s-j-gatewayd until the queue is full.
 func (s *JournalShipper) Run() error {
+	if s.QueueSize < 1 {
+		return fmt.Errorf("queue size must be at least 1")
+	}
 	logsCh, err := s.journal.Follow()
 	if err != nil {
 		return fmt.Errorf("Error reading from systemd-journal-gatewayd: %s", err.Error())
 	}
 
+	defer s.output.Close()
 	go s.updateLagMetric()
 
-	// loop forever reading messages from s-j-gatewayd and relaying them to logstash
-	// return with error if we lose connection to the gateway or run into errors sending to logstash
+	queue := make(chan *logstash.V1Event, s.QueueSize)
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- s.send(queue)
+	}()
+
+	// loop forever reading messages from s-j-gatewayd and queueing them for the output
+	// return with error if we lose connection to the gateway or run into errors sending to the output
 	for {
 		select {
 		case rawMessage := <-logsCh:
-			// channel is closed, we're done
+			// channel is closed, we're done once everything already queued has been written
 			if len(rawMessage) == 0 {
+				close(queue)
+				if err := <-sendErr; err != nil {
+					return err
+				}
 				return fmt.Errorf("lost connection to systemd-journal-gatewayd")
 			}
 
@@ -262,17 +419,75 @@ func (s *JournalShipper) Run() error {
 				continue
 			}
 
-			if _, err := s.logstash.Write(event); err != nil {
-				return fmt.Errorf("Error writing to logstash: %s", err)
+			start := time.Now()
+			select {
+			case queue <- event:
+				s.enqueueLatency.UpdateSince(start)
+				s.queueDepth.Update(int64(len(queue)))
+			case err := <-sendErr:
+				return err
+			}
+		case err := <-sendErr:
+			return err
+		}
+	}
+}
+
+// send writes events from the queue to the output until the queue is closed or an
+// error occurs. The cursor of the last event written is saved to the state file
+// every saveInterval, after flushing the output, and once more when the queue is closed.
+func (s *JournalShipper) send(queue <-chan *logstash.V1Event) error {
+	flushTick := time.NewTicker(s.flushInterval())
+	defer flushTick.Stop()
+	for {
+		select {
+		case event, ok := <-queue:
+			if !ok {
+				return s.flushAndSaveCursor()
+			}
+			s.queueDepth.Update(int64(len(queue)))
+
+			if _, err := s.output.Write(event); err != nil {
+				return fmt.Errorf("Error writing to %s output: %s", s.Output, err)
 			}
 			s.msgsSent.Inc(1)
 			s.lastSent = event.Timestamp
+			s.lastCursor = event.Fields["__CURSOR"]
 
 			if time.Since(s.lastStateSave) > saveInterval {
-				if err := s.saveCursor(event.Fields["__CURSOR"]); err != nil {
-					return fmt.Errorf("Error saving cursor: %s", err)
+				if err := s.flushAndSaveCursor(); err != nil {
+					return err
 				}
+				s.checkOutputHealth()
+			}
+		case <-flushTick.C:
+			if err := s.output.Flush(); err != nil {
+				return fmt.Errorf("Error flushing %s output: %s", s.Output, err)
 			}
 		}
 	}
 }
+
+// flushInterval returns FlushInterval, or what it defaults to.
+func (s *JournalShipper) flushInterval() time.Duration {
+	if s.FlushInterval > 0 {
+		return s.FlushInterval
+	}
+	if s.LogstashBatchMaxLatency > 0 {
+		return s.LogstashBatchMaxLatency
+	}
+	return defaultFlushInterval
+}
+
+// flushAndSaveCursor flushes the output and then saves the cursor of the last event
+// written to it. The cursor may only advance once the output has delivered
+// everything written to it.
+func (s *JournalShipper) flushAndSaveCursor() error {
+	if err := s.output.Flush(); err != nil {
+		return fmt.Errorf("Error flushing %s output: %s", s.Output, err)
+	}
+	if err := s.saveCursor(s.lastCursor); err != nil {
+		return fmt.Errorf("Error saving cursor: %s", err)
+	}
+	return nil
+}
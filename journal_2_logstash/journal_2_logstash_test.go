@@ -1,10 +1,16 @@
 package journal_2_logstash
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
+	"github.com/pantheon-systems/journal-2-logstash/file"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/pantheon-systems/journal-2-logstash/output"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -18,7 +24,7 @@ func Test_logstashEventFromJournal__message_as_string(t *testing.T) {
 	raw := []byte(journalMessageExample)
 	e, err := logstashEventFromJournal(&raw)
 	assert.Nil(t, err)
-	assert.Equal(t, "2016-01-28 23:51:34.000232472 +0000 UTC", e.Timestamp.String())
+	assert.Equal(t, "2016-01-28 23:51:34.232472 +0000 UTC", e.Timestamp.String())
 	assert.Equal(t, "foo", e.Message)
 	assert.Equal(t, "7260885021563", e.Fields["__MONOTONIC_TIMESTAMP"])
 }
@@ -28,7 +34,7 @@ func Test_logstashEventFromJournal__message_as_byte_array(t *testing.T) {
 	e, err := logstashEventFromJournal(&raw)
 	t.Log(e)
 	assert.Nil(t, err)
-	assert.Equal(t, "2016-01-28 23:51:34.000232472 +0000 UTC", e.Timestamp.String())
+	assert.Equal(t, "2016-01-28 23:51:34.232472 +0000 UTC", e.Timestamp.String())
 	assert.Equal(t, "foo", e.Message)
 	assert.Equal(t, "foo", e.Fields["COMMAND"])
 	assert.Equal(t, "7260885021563", e.Fields["__MONOTONIC_TIMESTAMP"])
@@ -37,7 +43,7 @@ func Test_logstashEventFromJournal__message_as_byte_array(t *testing.T) {
 func Test_timeFromJournalInt(t *testing.T) {
 	r := timeFromJournalInt(1460858962473842)
 	text, _ := r.MarshalText()
-	assert.Equal(t, []byte("2016-04-17T02:09:22.000473842Z"), text)
+	assert.Equal(t, []byte("2016-04-17T02:09:22.473842Z"), text)
 }
 
 func tempStateFile(t *testing.T) *os.File {
@@ -79,6 +85,115 @@ func TestMetrics(t *testing.T) {
 	assert.Equal(t, int64(42), s.msgsRead.Count())
 }
 
+// fakeOutput records the events written to it and fails every Write after the
+// first failAfter events, if failAfter is set.
+type fakeOutput struct {
+	events    []*logstash.V1Event
+	flushes   int
+	failAfter int
+}
+
+func (o *fakeOutput) Open() error   { return nil }
+func (o *fakeOutput) Close() error  { return nil }
+func (o *fakeOutput) Health() error { return nil }
+
+func (o *fakeOutput) Flush() error {
+	o.flushes++
+	return nil
+}
+
+func (o *fakeOutput) Write(e *logstash.V1Event) (int, error) {
+	if o.failAfter > 0 && len(o.events) >= o.failAfter {
+		return 0, errors.New("output is down")
+	}
+	o.events = append(o.events, e)
+	return len(e.Message), nil
+}
+
+func queuedEvents(count int) chan *logstash.V1Event {
+	queue := make(chan *logstash.V1Event, count)
+	for i := 1; i <= count; i++ {
+		e := logstash.NewV1Event()
+		e.Fields["__CURSOR"] = fmt.Sprintf("cursor-%d", i)
+		queue <- e
+	}
+	return queue
+}
+
+func Test_send__savesCursorOfLastWrittenEvent(t *testing.T) {
+	stateFile := tempStateFile(t)
+	defer os.Remove(stateFile.Name())
+
+	out := &fakeOutput{}
+	s := &JournalShipper{output: out, journalMetrics: newMetrics(), lastStateSave: time.Now()}
+	s.StateFile = stateFile.Name()
+
+	queue := queuedEvents(3)
+	close(queue)
+	assert.Nil(t, s.send(queue))
+	assert.Equal(t, 3, len(out.events))
+	assert.Equal(t, 1, out.flushes)
+
+	savedValue, _ := readStateFile(s.StateFile)
+	assert.Equal(t, "cursor-3", savedValue)
+}
+
+func Test_send__outputError(t *testing.T) {
+	stateFile := tempStateFile(t)
+	defer os.Remove(stateFile.Name())
+
+	// force a cursor save after every event
+	defer func(interval time.Duration) { saveInterval = interval }(saveInterval)
+	saveInterval = 0
+
+	out := &fakeOutput{failAfter: 2}
+	s := &JournalShipper{output: out, journalMetrics: newMetrics()}
+	s.StateFile = stateFile.Name()
+
+	queue := queuedEvents(3)
+	close(queue)
+	assert.NotNil(t, s.send(queue))
+
+	// the saved cursor must not point past the last event the output accepted
+	savedValue, _ := readStateFile(s.StateFile)
+	assert.Equal(t, "cursor-2", savedValue)
+}
+
+func Test_send__stateReadOnly(t *testing.T) {
+	stateFile := tempStateFile(t)
+	defer os.Remove(stateFile.Name())
+	writeStateFile(stateFile.Name(), "cursor-0")
+
+	out := &fakeOutput{}
+	s := &JournalShipper{output: out, journalMetrics: newMetrics(), lastStateSave: time.Now()}
+	s.StateFile = stateFile.Name()
+	s.StateReadOnly = true
+
+	queue := queuedEvents(3)
+	close(queue)
+	assert.Nil(t, s.send(queue))
+	assert.Equal(t, 3, len(out.events))
+	assert.Equal(t, 1, out.flushes)
+
+	savedValue, _ := readStateFile(s.StateFile)
+	assert.Equal(t, "cursor-0", savedValue)
+}
+
+func Test_newOutput__unknown(t *testing.T) {
+	_, err := newOutput(JournalShipperConfig{Output: "carrier-pigeon"})
+	assert.EqualError(t, err, "unknown output: carrier-pigeon")
+}
+
+func Test_newOutput__fileAlongside(t *testing.T) {
+	out, err := newOutput(JournalShipperConfig{Output: "logstash-http", URLs: []string{"http://logstash:8080"}, Plaintext: true, FilePath: "events.json"})
+	assert.Nil(t, err)
+	assert.IsType(t, &output.Tee{}, out)
+
+	out, err = newOutput(JournalShipperConfig{Output: "file", FilePath: "events.json"})
+	assert.Nil(t, err)
+	assert.IsType(t, &file.File{}, out)
+}
+
 //func Test_Run(t *testing.T) {
 //	// setup a fake journal, and fake TLS receiver
 //	// test save is called when lastsave>SAVEINTERVAL
@@ -94,3 +209,12 @@ func TestMetrics(t *testing.T) {
 //	}
 //
 //}
+
+func Test_flushInterval(t *testing.T) {
+	s := &JournalShipper{}
+	assert.Equal(t, defaultFlushInterval, s.flushInterval())
+	s.LogstashBatchMaxLatency = 5 * time.Second
+	assert.Equal(t, 5*time.Second, s.flushInterval())
+	s.FlushInterval = 2 * time.Second
+	assert.Equal(t, 2*time.Second, s.flushInterval())
+}
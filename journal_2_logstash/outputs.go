@@ -0,0 +1,326 @@
+package journal_2_logstash
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+
+	"github.com/pantheon-systems/journal-2-logstash/elasticsearch"
+	"github.com/pantheon-systems/journal-2-logstash/file"
+	"github.com/pantheon-systems/journal-2-logstash/gelf"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/pantheon-systems/journal-2-logstash/logstashhttp"
+	"github.com/pantheon-systems/journal-2-logstash/loki"
+	"github.com/pantheon-systems/journal-2-logstash/lumberjack"
+	"github.com/pantheon-systems/journal-2-logstash/otlp"
+	"github.com/pantheon-systems/journal-2-logstash/output"
+	"github.com/pantheon-systems/journal-2-logstash/splunkhec"
+	"github.com/pantheon-systems/journal-2-logstash/spool"
+	"github.com/pantheon-systems/journal-2-logstash/stdout"
+	"github.com/pantheon-systems/journal-2-logstash/syslog"
+)
+
+// compile-time checks that each output implements output.Output
+var (
+	_ output.Output = (*logstash.Client)(nil)
+	_ output.Output = (*elasticsearch.Client)(nil)
+	_ output.Output = (*logstashhttp.Client)(nil)
+	_ output.Output = (*gelf.Client)(nil)
+	_ output.Output = (*syslog.Client)(nil)
+	_ output.Output = (*loki.Client)(nil)
+	_ output.Output = (*splunkhec.Client)(nil)
+	_ output.Output = (*otlp.Client)(nil)
+	_ output.Output = (*lumberjack.Client)(nil)
+	_ output.Output = (*spool.Spool)(nil)
+	_ output.Output = (*file.File)(nil)
+	_ output.Output = (*stdout.Output)(nil)
+	_ output.Output = (*output.Tee)(nil)
+)
+
+// newOutput returns the output.Output selected by cfg.Output, wrapped in a disk spool
+// if cfg.SpoolDir is set. If cfg.FilePath is set alongside a network output, events
+// are also written to the file; a dry run to stdout leaves the file alone. The returned output has not been opened yet.
+func newOutput(cfg JournalShipperConfig) (output.Output, error) {
+	out, err := newDestination(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SpoolDir != "" {
+		if out, err = spool.New(spool.Config{
+			Dir:          cfg.SpoolDir,
+			MaxBytes:     cfg.SpoolMaxBytes,
+			SegmentBytes: cfg.SpoolSegmentBytes,
+			Overflow:     cfg.SpoolOverflow,
+			Retry:        cfg.LogstashRetry,
+		}, out); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.FilePath == "" || cfg.Output == "file" || cfg.Output == "stdout" {
+		return out, nil
+	}
+	f, err := newFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return output.NewTee(f, out), nil
+}
+
+func newFile(cfg JournalShipperConfig) (*file.File, error) {
+	return file.New(file.Config{
+		Path:           cfg.FilePath,
+		MaxBytes:       cfg.FileMaxBytes,
+		RotateInterval: cfg.FileRotateInterval,
+		Compress:       cfg.FileCompress,
+		MaxFiles:       cfg.FileMaxFiles,
+		MaxAge:         cfg.FileMaxAge,
+	})
+}
+
+// newDestination returns the output.Output selected by cfg.Output.
+//
+// To add a new destination, implement output.Output in its own package and add
+// a case for it here.
+func newDestination(cfg JournalShipperConfig) (output.Output, error) {
+	tlsOptions, err := logstash.ParseTLSOptions(cfg.TLSMinVersion, cfg.TLSCipherSuites, cfg.TLSServerName, cfg.TLSPinnedSPKI)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Output {
+	case "", "logstash":
+		return logstash.NewClient(logstash.Config{
+			URLs:              cfg.URLs,
+			Strategy:          cfg.LogstashStrategy,
+			EjectAfter:        cfg.LogstashEjectAfter,
+			EjectDuration:     cfg.LogstashEjectDuration,
+			SRV:               cfg.LogstashSRV,
+			SRVRefresh:        cfg.LogstashSRVRefresh,
+			Key:               cfg.Key,
+			Cert:              cfg.Cert,
+			Ca:                cfg.Ca,
+			PKCS12:            cfg.PKCS12,
+			KeyPassphraseFile: cfg.KeyPassphraseFile,
+			Plaintext:         cfg.Plaintext,
+			Timeout:           cfg.Timeout,
+			TLSOptions:        tlsOptions,
+			TLSReloadInterval: cfg.TLSReloadInterval,
+			BatchMaxEvents:    cfg.LogstashBatchMaxEvents,
+			BatchMaxBytes:     cfg.LogstashBatchMaxBytes,
+			BatchMaxLatency:   cfg.LogstashBatchMaxLatency,
+			ReconnectAge:      cfg.LogstashReconnectAge,
+			ReconnectJitter:   cfg.LogstashReconnectJitter,
+			Proxy:             cfg.LogstashProxy,
+			Retry:             cfg.LogstashRetry,
+		})
+	case "lumberjack":
+		if len(cfg.URLs) != 1 {
+			return nil, errors.New("the lumberjack output requires exactly one URL")
+		}
+		tlsConfig, err := newTLSConfig(cfg, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		return lumberjack.NewClient(lumberjack.Config{
+			URL:              cfg.URLs[0],
+			TLSConfig:        tlsConfig,
+			Timeout:          cfg.Timeout,
+			WindowSize:       cfg.LumberjackWindowSize,
+			CompressionLevel: cfg.LumberjackCompressionLevel,
+			Retry:            cfg.LogstashRetry,
+		})
+	case "logstash-http":
+		tlsConfig, err := newTLSConfig(cfg, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		return logstashhttp.NewClient(logstashhttp.Config{
+			URLs:             cfg.URLs,
+			TLSConfig:        tlsConfig,
+			Timeout:          cfg.Timeout,
+			BatchMaxEvents:   cfg.LogstashBatchMaxEvents,
+			BatchMaxBytes:    cfg.LogstashBatchMaxBytes,
+			CompressionLevel: cfg.LogstashHTTPCompressionLevel,
+			Retry:            cfg.LogstashRetry,
+		})
+	case "elasticsearch":
+		tlsConfig, err := newTLSConfig(cfg, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		return elasticsearch.NewClient(elasticsearch.Config{
+			URLs:            cfg.URLs,
+			Index:           cfg.ElasticsearchIndex,
+			Pipeline:        cfg.ElasticsearchPipeline,
+			Username:        cfg.ElasticsearchUsername,
+			Password:        cfg.ElasticsearchPassword,
+			APIKey:          cfg.ElasticsearchAPIKey,
+			TLSConfig:       tlsConfig,
+			Timeout:         cfg.Timeout,
+			BatchMaxEvents:  cfg.ElasticsearchBatchMaxEvents,
+			BatchMaxBytes:   cfg.ElasticsearchBatchMaxBytes,
+			RetryMaxElapsed: cfg.ElasticsearchRetryMaxElapsed,
+		})
+	case "gelf":
+		if len(cfg.URLs) != 1 {
+			return nil, errors.New("the gelf output requires exactly one URL")
+		}
+		var tlsConfig *tls.Config
+		if cfg.GELFProtocol != "udp" {
+			if tlsConfig, err = newTLSConfig(cfg, tlsOptions); err != nil {
+				return nil, err
+			}
+		}
+		return gelf.NewClient(gelf.Config{
+			URL:         cfg.URLs[0],
+			Protocol:    cfg.GELFProtocol,
+			TLSConfig:   tlsConfig,
+			Timeout:     cfg.Timeout,
+			Compression: cfg.GELFCompression,
+			ChunkSize:   cfg.GELFChunkSize,
+			Retry:       cfg.LogstashRetry,
+		})
+	case "syslog":
+		if len(cfg.URLs) != 1 {
+			return nil, errors.New("the syslog output requires exactly one URL")
+		}
+		tlsConfig, err := newTLSConfig(cfg, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		return syslog.NewClient(syslog.Config{
+			URL:                  cfg.URLs[0],
+			TLSConfig:            tlsConfig,
+			Timeout:              cfg.Timeout,
+			Facility:             cfg.SyslogFacility,
+			SDID:                 cfg.SyslogSDID,
+			StructuredDataFields: cfg.SyslogSDFields,
+			Retry:                cfg.LogstashRetry,
+		})
+	case "loki":
+		if len(cfg.URLs) != 1 {
+			return nil, errors.New("the loki output requires exactly one URL")
+		}
+		labels, err := loki.ParseLabels(cfg.LokiStaticLabels)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := newTLSConfig(cfg, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		return loki.NewClient(loki.Config{
+			URL:             cfg.URLs[0],
+			Format:          cfg.LokiFormat,
+			TLSConfig:       tlsConfig,
+			Timeout:         cfg.Timeout,
+			LabelFields:     cfg.LokiLabelFields,
+			StaticLabels:    labels,
+			TenantID:        cfg.LokiTenantID,
+			Username:        cfg.LokiUsername,
+			Password:        cfg.LokiPassword,
+			BatchMaxEvents:  cfg.LokiBatchMaxEvents,
+			BatchMaxBytes:   cfg.LokiBatchMaxBytes,
+			RetryMaxElapsed: cfg.LokiRetryMaxElapsed,
+		})
+	case "splunk-hec":
+		if len(cfg.URLs) != 1 {
+			return nil, errors.New("the splunk-hec output requires exactly one URL")
+		}
+		var rules []splunkhec.Rule
+		for _, s := range cfg.SplunkRules {
+			rule, err := splunkhec.ParseRule(s)
+			if err != nil {
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+		tlsConfig, err := newTLSConfig(cfg, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		return splunkhec.NewClient(splunkhec.Config{
+			URL:             cfg.URLs[0],
+			Token:           cfg.SplunkToken,
+			TLSConfig:       tlsConfig,
+			Timeout:         cfg.Timeout,
+			Sourcetype:      cfg.SplunkSourcetype,
+			Index:           cfg.SplunkIndex,
+			Rules:           rules,
+			UseAck:          cfg.SplunkUseAck,
+			Channel:         cfg.SplunkChannel,
+			AckTimeout:      cfg.SplunkAckTimeout,
+			BatchMaxEvents:  cfg.SplunkBatchMaxEvents,
+			BatchMaxBytes:   cfg.SplunkBatchMaxBytes,
+			RetryMaxElapsed: cfg.SplunkRetryMaxElapsed,
+		})
+	case "otlp":
+		if len(cfg.URLs) != 1 {
+			return nil, errors.New("the otlp output requires exactly one URL")
+		}
+		headers, err := otlp.ParseHeaders(cfg.OTLPHeaders)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig, err := newTLSConfig(cfg, tlsOptions)
+		if err != nil {
+			return nil, err
+		}
+		return otlp.NewClient(otlp.Config{
+			URL:             cfg.URLs[0],
+			TLSConfig:       tlsConfig,
+			Timeout:         cfg.Timeout,
+			Headers:         headers,
+			Format:          cfg.OTLPFormat,
+			Compression:     cfg.OTLPCompression,
+			BatchMaxEvents:  cfg.OTLPBatchMaxEvents,
+			BatchMaxBytes:   cfg.OTLPBatchMaxBytes,
+			RetryMaxElapsed: cfg.OTLPRetryMaxElapsed,
+		})
+	case "unix":
+		if len(cfg.URLs) == 0 {
+			return nil, errors.New("the unix output requires a socket path")
+		}
+		return logstash.NewClient(logstash.Config{
+			URLs:            cfg.URLs,
+			Strategy:        cfg.LogstashStrategy,
+			EjectAfter:      cfg.LogstashEjectAfter,
+			EjectDuration:   cfg.LogstashEjectDuration,
+			Network:         cfg.UnixNetwork,
+			Plaintext:       true,
+			Timeout:         cfg.Timeout,
+			BatchMaxEvents:  cfg.LogstashBatchMaxEvents,
+			BatchMaxBytes:   cfg.LogstashBatchMaxBytes,
+			BatchMaxLatency: cfg.LogstashBatchMaxLatency,
+			Retry:           cfg.LogstashRetry,
+		})
+	case "file":
+		return newFile(cfg)
+	case "stdout":
+		return stdout.New(stdout.Config{Format: cfg.StdoutFormat})
+	default:
+		return nil, fmt.Errorf("unknown output: %s", cfg.Output)
+	}
+}
+
+// newTLSConfig returns the *tls.Config for destinations that take one, or nil in
+// plaintext mode. The client cert it presents and the CA bundle it verifies servers
+// against are reloaded every cfg.TLSReloadInterval and on SIGHUP, and used from the
+// next connection on.
+func newTLSConfig(cfg JournalShipperConfig, opts logstash.TLSOptions) (*tls.Config, error) {
+	if cfg.Plaintext {
+		return nil, nil
+	}
+	reloader, err := logstash.NewTLSReloader(logstash.TLSFiles{
+		Key:            cfg.Key,
+		Cert:           cfg.Cert,
+		Ca:             cfg.Ca,
+		PKCS12:         cfg.PKCS12,
+		PassphraseFile: cfg.KeyPassphraseFile,
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	reloader.Watch(cfg.TLSReloadInterval)
+	return reloader.SharedConfig(), nil
+}
@@ -0,0 +1,179 @@
+package logstash
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// TLSFiles are the paths of the TLS material a client loads. When the process runs
+// under systemd with LoadCredential=, relative paths are resolved against
+// $CREDENTIALS_DIRECTORY, so keys never need to be stored in /etc.
+type TLSFiles struct {
+	// Key and Cert are the optional client key and cert, in PEM. Key may be encrypted,
+	// in which case PassphraseFile must be set.
+	Key  string
+	Cert string
+	// Ca is the CA bundle used to authenticate servers, or the system's pool if empty.
+	Ca string
+	// PKCS12 is a bundle of the client key, cert and intermediate certs, used instead of
+	// Key and Cert.
+	PKCS12 string
+	// PassphraseFile holds the passphrase of an encrypted Key or of PKCS12. A trailing
+	// newline is ignored.
+	PassphraseFile string
+}
+
+// resolve returns f with relative paths made relative to $CREDENTIALS_DIRECTORY, if set.
+func (f TLSFiles) resolve() TLSFiles {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return f
+	}
+	for _, p := range []*string{&f.Key, &f.Cert, &f.Ca, &f.PKCS12, &f.PassphraseFile} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(dir, *p)
+		}
+	}
+	return f
+}
+
+func (f TLSFiles) validate() error {
+	if (f.Key == "") != (f.Cert == "") {
+		return errors.New("a client key and cert must be given together")
+	}
+	if f.PKCS12 != "" && f.Key != "" {
+		return errors.New("a PKCS#12 bundle cannot be combined with a client key and cert")
+	}
+	return nil
+}
+
+// paths returns the files that are loaded, with "" for unset ones.
+func (f TLSFiles) paths() []string {
+	return []string{f.Key, f.Cert, f.Ca, f.PKCS12, f.PassphraseFile}
+}
+
+// certSource returns the file the client cert is loaded from, for logging.
+func (f TLSFiles) certSource() string {
+	if f.PKCS12 != "" {
+		return f.PKCS12
+	}
+	return f.Cert
+}
+
+// load loads the client cert, if any, and the CA bundle, if any.
+func (f TLSFiles) load() (*tls.Certificate, *x509.CertPool, error) {
+	passphrase, err := f.passphrase()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var cert *tls.Certificate
+	switch {
+	case f.PKCS12 != "":
+		if cert, err = loadPKCS12(f.PKCS12, passphrase); err != nil {
+			return nil, nil, err
+		}
+	case f.Key != "":
+		if cert, err = loadKeyPair(f.Key, f.Cert, passphrase); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var roots *x509.CertPool
+	if f.Ca != "" {
+		caCert, err := ioutil.ReadFile(f.Ca)
+		if err != nil {
+			return nil, nil, err
+		}
+		roots = x509.NewCertPool()
+		if ok := roots.AppendCertsFromPEM(caCert); !ok {
+			return nil, nil, errors.New("failed to parse CA certs")
+		}
+	}
+	return cert, roots, nil
+}
+
+func (f TLSFiles) passphrase() ([]byte, error) {
+	if f.PassphraseFile == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(f.PassphraseFile)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(b, "\r\n"), nil
+}
+
+// loadKeyPair loads a PEM cert and key, decrypting the key with passphrase if it is
+// encrypted, either with legacy OpenSSL PEM encryption or as an encrypted PKCS#8 key.
+func loadKeyPair(keyFile, certFile string, passphrase []byte) (*tls.Certificate, error) {
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(keyPEM)
+	if block != nil && (block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block)) {
+		if passphrase == nil {
+			return nil, fmt.Errorf("%s is encrypted but no passphrase file was given", keyFile)
+		}
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("decrypting %s: %s", keyFile, err)
+			}
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		} else {
+			der, err := x509.DecryptPEMBlock(block, passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("decrypting %s: %s", keyFile, err)
+			}
+			keyPEM = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+		}
+	}
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// loadPKCS12 loads the client key, cert and intermediate certs from a PKCS#12 bundle.
+func loadPKCS12(file string, passphrase []byte) (*tls.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, string(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %s", file, err)
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{leaf.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
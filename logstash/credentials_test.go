@@ -0,0 +1,56 @@
+package logstash
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fixtures = "../test/fixtures/certs/"
+
+func TestTLSFiles__resolve(t *testing.T) {
+	files := TLSFiles{Key: "client.key", Cert: "/etc/certs/client.crt"}
+	assert.Equal(t, files, files.resolve())
+
+	os.Setenv("CREDENTIALS_DIRECTORY", "/run/credentials/journal-2-logstash.service")
+	defer os.Unsetenv("CREDENTIALS_DIRECTORY")
+	resolved := files.resolve()
+	assert.Equal(t, "/run/credentials/journal-2-logstash.service/client.key", resolved.Key)
+	assert.Equal(t, "/etc/certs/client.crt", resolved.Cert)
+	assert.Equal(t, "", resolved.Ca)
+}
+
+func TestTLSFiles__encryptedKeys(t *testing.T) {
+	plain, _, err := TLSFiles{Key: fixtures + "logger.key", Cert: fixtures + "logger.crt"}.load()
+	assert.Nil(t, err)
+
+	for _, key := range []string{"logger.pkcs8.key", "logger.legacy.key"} {
+		cert, _, err := TLSFiles{
+			Key:            fixtures + key,
+			Cert:           fixtures + "logger.crt",
+			PassphraseFile: fixtures + "logger.passphrase",
+		}.load()
+		assert.Nil(t, err, key)
+		assert.Equal(t, plain.PrivateKey, cert.PrivateKey, key)
+
+		_, _, err = TLSFiles{Key: fixtures + key, Cert: fixtures + "logger.crt"}.load()
+		assert.Contains(t, err.Error(), "no passphrase file", key)
+		_, _, err = TLSFiles{Key: fixtures + key, Cert: fixtures + "logger.crt", PassphraseFile: fixtures + "ca.crt"}.load()
+		assert.NotNil(t, err, key)
+	}
+}
+
+func TestTLSFiles__pkcs12(t *testing.T) {
+	plain, _, err := TLSFiles{Key: fixtures + "logger.key", Cert: fixtures + "logger.crt"}.load()
+	assert.Nil(t, err)
+
+	cert, _, err := TLSFiles{PKCS12: fixtures + "logger.p12", PassphraseFile: fixtures + "logger.passphrase"}.load()
+	assert.Nil(t, err)
+	assert.Equal(t, plain.PrivateKey, cert.PrivateKey)
+	assert.Equal(t, "logger", cert.Leaf.Subject.CommonName)
+	// the bundle's CA cert is sent as part of the chain
+	assert.Equal(t, 2, len(cert.Certificate))
+
+	assert.NotNil(t, TLSFiles{PKCS12: "bundle.p12", Key: "client.key", Cert: "client.crt"}.validate())
+}
@@ -0,0 +1,278 @@
+package logstash
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// Strategies for choosing which endpoint the Client connects to.
+const (
+	// StrategyRoundRobin cycles through the healthy endpoints on each connect.
+	StrategyRoundRobin = "round-robin"
+	// StrategyRandom picks a random healthy endpoint on each connect.
+	StrategyRandom = "random"
+	// StrategyFailover connects to the first healthy endpoint in the order they were configured.
+	StrategyFailover = "failover"
+	// StrategyLeastErrors connects to the healthy endpoint with the fewest errors in the
+	// last errorWindow, falling back to round-robin between endpoints with equal counts.
+	StrategyLeastErrors = "least-recent-errors"
+	// StrategySRV is used when the endpoints were discovered from a DNS SRV record. It
+	// connects to the healthy endpoints with the lowest priority, choosing between them
+	// at random in proportion to their weights, as described in RFC 2782.
+	StrategySRV = "srv"
+)
+
+var (
+	// errors older than this are forgotten by StrategyLeastErrors
+	errorWindow = time.Duration(10) * time.Minute
+	// used when Config.EjectDuration is not set
+	defaultEjectDuration = time.Duration(30) * time.Second
+)
+
+// endpoint is a logstash server that the Client may connect to.
+type endpoint struct {
+	url string
+	// SRV record priority and weight, used by StrategySRV
+	priority uint16
+	weight   uint16
+	// consecutive connect or write failures since the last successful connect
+	failures     int
+	recentErrors []time.Time
+	ejectedUntil time.Time
+	endpointMetrics
+}
+
+type endpointMetrics struct {
+	connects      metrics.Counter
+	connectErrors metrics.Counter
+	writeErrors   metrics.Counter
+	ejections     metrics.Counter
+	healthy       metrics.Gauge
+}
+
+func newEndpoint(url string) *endpoint {
+	prefix := "logstash_endpoint." + strings.NewReplacer(".", "_", ":", "_").Replace(url) + "."
+	r := metrics.DefaultRegistry
+	e := &endpoint{
+		url: url,
+		endpointMetrics: endpointMetrics{
+			connects:      metrics.GetOrRegisterCounter(prefix+"connects", r),
+			connectErrors: metrics.GetOrRegisterCounter(prefix+"connect_errors", r),
+			writeErrors:   metrics.GetOrRegisterCounter(prefix+"write_errors", r),
+			ejections:     metrics.GetOrRegisterCounter(prefix+"ejections", r),
+			healthy:       metrics.GetOrRegisterGauge(prefix+"healthy", r),
+		},
+	}
+	e.healthy.Update(1)
+	return e
+}
+
+func (e *endpoint) ejected(now time.Time) bool {
+	return now.Before(e.ejectedUntil)
+}
+
+// errorsSince prunes and returns the number of errors recorded after t.
+func (e *endpoint) errorsSince(t time.Time) int {
+	i := 0
+	for i < len(e.recentErrors) && e.recentErrors[i].Before(t) {
+		i++
+	}
+	e.recentErrors = e.recentErrors[i:]
+	return len(e.recentErrors)
+}
+
+// endpointPool tracks the health of a set of endpoints and chooses between them.
+//
+// An endpoint that fails ejectAfter times in a row is ejected, and not chosen again
+// until ejectFor has passed, unless every endpoint is ejected.
+type endpointPool struct {
+	endpoints  []*endpoint
+	strategy   string
+	ejectAfter int
+	ejectFor   time.Duration
+	next       int
+	rand       *rand.Rand
+}
+
+// newEndpointPool returns an endpointPool for urls. With StrategySRV the pool starts out
+// empty and is filled by update.
+func newEndpointPool(urls []string, strategy string, ejectAfter int, ejectFor time.Duration) (*endpointPool, error) {
+	switch strategy {
+	case StrategyRoundRobin, StrategyRandom, StrategyFailover, StrategyLeastErrors:
+		if len(urls) == 0 {
+			return nil, fmt.Errorf("at least one logstash URL is required")
+		}
+	case StrategySRV:
+	default:
+		return nil, fmt.Errorf("unknown endpoint strategy: %s", strategy)
+	}
+	p := &endpointPool{
+		strategy:   strategy,
+		ejectAfter: ejectAfter,
+		ejectFor:   ejectFor,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for _, url := range urls {
+		p.endpoints = append(p.endpoints, newEndpoint(url))
+	}
+	return p, nil
+}
+
+// update replaces the pool's endpoints with the targets of SRV records. Endpoints that
+// were already in the pool keep their health history.
+func (p *endpointPool) update(records []*net.SRV) {
+	existing := make(map[string]*endpoint)
+	for _, e := range p.endpoints {
+		existing[e.url] = e
+	}
+	endpoints := []*endpoint{}
+	for _, r := range records {
+		url := net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))
+		e, ok := existing[url]
+		if !ok {
+			e = newEndpoint(url)
+		}
+		e.priority = r.Priority
+		e.weight = r.Weight
+		endpoints = append(endpoints, e)
+	}
+	p.endpoints = endpoints
+}
+
+// urls returns the endpoints' addresses as a comma separated list.
+func (p *endpointPool) urls() string {
+	urls := []string{}
+	for _, e := range p.endpoints {
+		urls = append(urls, e.url)
+	}
+	return strings.Join(urls, ",")
+}
+
+// candidates returns the endpoints that are not ejected, or all endpoints if every
+// one of them is ejected.
+func (p *endpointPool) candidates(now time.Time) []*endpoint {
+	healthy := []*endpoint{}
+	for _, e := range p.endpoints {
+		if !e.ejected(now) {
+			healthy = append(healthy, e)
+		}
+	}
+	if len(healthy) == 0 {
+		return p.endpoints
+	}
+	return healthy
+}
+
+// pick chooses the endpoint for the next connection attempt. It returns nil if the
+// pool is empty.
+func (p *endpointPool) pick() *endpoint {
+	if len(p.endpoints) == 0 {
+		return nil
+	}
+	now := time.Now()
+	candidates := p.candidates(now)
+
+	switch p.strategy {
+	case StrategyRandom:
+		return candidates[p.rand.Intn(len(candidates))]
+	case StrategyFailover:
+		return candidates[0]
+	case StrategySRV:
+		return p.pickSRV(candidates)
+	case StrategyLeastErrors:
+		p.next++
+		var best *endpoint
+		bestErrors := 0
+		for i := range candidates {
+			e := candidates[(p.next+i)%len(candidates)]
+			n := e.errorsSince(now.Add(-errorWindow))
+			if best == nil || n < bestErrors {
+				best, bestErrors = e, n
+			}
+		}
+		return best
+	default:
+		p.next++
+		return candidates[p.next%len(candidates)]
+	}
+}
+
+// pickSRV chooses at random, in proportion to their weights, between the candidates
+// with the lowest priority. As RFC 2782 describes, targets of weight 0 are placed first
+// and a number between 0 and the total weight inclusive is drawn, so that they keep a
+// small chance of being chosen alongside weighted targets.
+func (p *endpointPool) pickSRV(candidates []*endpoint) *endpoint {
+	lowest := candidates[0].priority
+	for _, e := range candidates {
+		if e.priority < lowest {
+			lowest = e.priority
+		}
+	}
+	zeroWeight := []*endpoint{}
+	weighted := []*endpoint{}
+	totalWeight := 0
+	for _, e := range candidates {
+		if e.priority != lowest {
+			continue
+		}
+		if e.weight == 0 {
+			zeroWeight = append(zeroWeight, e)
+		} else {
+			weighted = append(weighted, e)
+			totalWeight += int(e.weight)
+		}
+	}
+	if totalWeight == 0 {
+		return zeroWeight[p.rand.Intn(len(zeroWeight))]
+	}
+	n := p.rand.Intn(totalWeight + 1)
+	if n == 0 && len(zeroWeight) > 0 {
+		return zeroWeight[p.rand.Intn(len(zeroWeight))]
+	}
+	// the first target whose running sum of weights reaches n
+	for _, e := range weighted {
+		if n <= int(e.weight) {
+			return e
+		}
+		n -= int(e.weight)
+	}
+	return weighted[len(weighted)-1]
+}
+
+// success records a successful connection to e.
+func (p *endpointPool) success(e *endpoint) {
+	e.failures = 0
+	e.connects.Inc(1)
+	e.healthy.Update(1)
+}
+
+// connectFailure records a failed connection attempt to e.
+func (p *endpointPool) connectFailure(e *endpoint) {
+	e.connectErrors.Inc(1)
+	p.failure(e)
+}
+
+// writeFailure records a failed write on a connection to e.
+func (p *endpointPool) writeFailure(e *endpoint) {
+	e.writeErrors.Inc(1)
+	p.failure(e)
+}
+
+func (p *endpointPool) failure(e *endpoint) {
+	now := time.Now()
+	e.failures++
+	e.recentErrors = append(e.recentErrors, now)
+	if p.ejectAfter > 0 && e.failures >= p.ejectAfter && !e.ejected(now) {
+		log.Printf("Ejecting logstash server %s for %s after %d consecutive failures", e.url, p.ejectFor, e.failures)
+		e.ejectedUntil = now.Add(p.ejectFor)
+		e.ejections.Inc(1)
+		e.healthy.Update(0)
+	}
+}
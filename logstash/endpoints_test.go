@@ -0,0 +1,70 @@
+package logstash
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func urlsPicked(p *endpointPool, count int) []string {
+	urls := []string{}
+	for i := 0; i < count; i++ {
+		urls = append(urls, p.pick().url)
+	}
+	return urls
+}
+
+func TestEndpointPool__unknownStrategy(t *testing.T) {
+	_, err := newEndpointPool([]string{"a:1"}, "fastest", 3, time.Second)
+	assert.EqualError(t, err, "unknown endpoint strategy: fastest")
+
+	_, err = newEndpointPool([]string{}, StrategyRoundRobin, 3, time.Second)
+	assert.NotNil(t, err)
+}
+
+func TestEndpointPool__roundRobin(t *testing.T) {
+	p, err := newEndpointPool([]string{"a:1", "b:1", "c:1"}, StrategyRoundRobin, 3, time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b:1", "c:1", "a:1", "b:1"}, urlsPicked(p, 4))
+}
+
+func TestEndpointPool__failoverAndEjection(t *testing.T) {
+	p, err := newEndpointPool([]string{"a:1", "b:1"}, StrategyFailover, 2, time.Hour)
+	assert.Nil(t, err)
+	a := p.endpoints[0]
+	assert.Equal(t, []string{"a:1", "a:1"}, urlsPicked(p, 2))
+
+	// one failure is tolerated, the second ejects the endpoint
+	p.connectFailure(a)
+	assert.Equal(t, "a:1", p.pick().url)
+	p.connectFailure(a)
+	assert.Equal(t, "b:1", p.pick().url)
+	assert.Equal(t, int64(0), a.healthy.Value())
+
+	// once the ejection expires the preferred endpoint is used again
+	a.ejectedUntil = time.Now().Add(-time.Second)
+	assert.Equal(t, "a:1", p.pick().url)
+}
+
+func TestEndpointPool__allEjected(t *testing.T) {
+	p, err := newEndpointPool([]string{"a:1"}, StrategyFailover, 1, time.Hour)
+	assert.Nil(t, err)
+	p.writeFailure(p.endpoints[0])
+	assert.Equal(t, "a:1", p.pick().url)
+}
+
+func TestEndpointPool__leastRecentErrors(t *testing.T) {
+	p, err := newEndpointPool([]string{"a:1", "b:1", "c:1"}, StrategyLeastErrors, 0, time.Hour)
+	assert.Nil(t, err)
+	p.connectFailure(p.endpoints[0])
+	p.connectFailure(p.endpoints[2])
+	p.connectFailure(p.endpoints[2])
+	assert.Equal(t, []string{"b:1", "b:1"}, urlsPicked(p, 2))
+
+	// old errors are forgotten
+	p.endpoints[0].recentErrors[0] = time.Now().Add(-2 * errorWindow)
+	picked := urlsPicked(p, 2)
+	assert.Contains(t, picked, "a:1")
+	assert.NotContains(t, picked, "c:1")
+}
@@ -1,11 +1,15 @@
 package logstash
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"testing"
 	"time"
 
@@ -39,6 +43,10 @@ func makeTLSConfigFromFiles(keyFile, certFile, caFile string) (*tls.Config, erro
 }
 
 func setup(t *testing.T, timeout time.Duration) {
+	setupWithConfig(t, Config{Timeout: timeout})
+}
+
+func setupWithConfig(t *testing.T, cfg Config) {
 	var err error
 
 	// setup mock logstash TLS (basic tcp socket) server
@@ -50,13 +58,22 @@ func setup(t *testing.T, timeout time.Duration) {
 	assert.Nil(t, err)
 
 	// setup logstash tls client
-	client, err = NewClient(server.Address(),
-		"../test/fixtures/certs/logger.key",
-		"../test/fixtures/certs/logger.crt",
-		"../test/fixtures/certs/ca.crt",
-		timeout)
+	// an empty URL is replaced by the mock server's address
+	if len(cfg.URLs) == 0 {
+		cfg.URLs = []string{""}
+	}
+	for i, url := range cfg.URLs {
+		if url == "" {
+			cfg.URLs[i] = server.Address()
+		}
+	}
+	cfg.Key = "../test/fixtures/certs/logger.key"
+	cfg.Cert = "../test/fixtures/certs/logger.crt"
+	cfg.Ca = "../test/fixtures/certs/ca.crt"
+	client, err = NewClient(cfg)
 	assert.Nil(t, err)
 	assert.NotNil(t, client)
+	assert.Nil(t, client.Open())
 }
 
 func teardown() {
@@ -78,7 +95,7 @@ func TestWrite(t *testing.T) {
 }
 
 func TestWriteTimeout(t *testing.T) {
-	setup(t, time.Duration(-5*time.Second))
+	setupWithConfig(t, Config{Timeout: time.Duration(-5 * time.Second), Retry: RetryPolicy{MaxAttempts: 2}})
 	defer teardown()
 	event := referenceEvent()
 
@@ -87,6 +104,113 @@ func TestWriteTimeout(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestHealth(t *testing.T) {
+	setup(t, time.Duration(5*time.Second))
+	defer teardown()
+	assert.Nil(t, client.Health())
+
+	unopened, err := NewClient(Config{
+		URLs:    []string{server.Address()},
+		Key:     "../test/fixtures/certs/logger.key",
+		Cert:    "../test/fixtures/certs/logger.crt",
+		Ca:      "../test/fixtures/certs/ca.crt",
+		Timeout: time.Duration(5 * time.Second),
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, unopened.Health())
+}
+
+func TestWriteBatch(t *testing.T) {
+	setupWithConfig(t, Config{Timeout: time.Duration(5 * time.Second), BatchMaxEvents: 3})
+	defer teardown()
+
+	// the first two events are held in the batch
+	client.Write(referenceEvent())
+	client.Write(referenceEvent())
+	assert.NotNil(t, server.WaitForLines(1, 100*time.Millisecond))
+	assert.Equal(t, 2, client.batchEvents)
+
+	// the third event fills the batch, which is written whole
+	_, err := client.Write(referenceEvent())
+	assert.Nil(t, err)
+	assert.Nil(t, server.WaitForLines(3, time.Second))
+	assert.Equal(t, 0, client.batchEvents)
+
+	// Flush writes a partial batch
+	client.Write(referenceEvent())
+	assert.Nil(t, client.Flush())
+	assert.Nil(t, server.WaitForLines(4, time.Second))
+
+	expected := fmt.Sprintf("{\"@timestamp\":\"%s\",\"@version\":1,\"extra_field\":\"text here\",\"message\":\"foo\"}", referenceTimeString)
+	for _, line := range server.Lines() {
+		assert.Equal(t, expected, line)
+	}
+}
+
+func TestWriteBatch__maxBytes(t *testing.T) {
+	setupWithConfig(t, Config{Timeout: time.Duration(5 * time.Second), BatchMaxEvents: 100, BatchMaxBytes: 150})
+	defer teardown()
+
+	// each line is ~90 bytes so the second event doesn't fit and the first is written alone
+	client.Write(referenceEvent())
+	client.Write(referenceEvent())
+	assert.Nil(t, server.WaitForLines(1, time.Second))
+	assert.Equal(t, 1, client.batchEvents)
+}
+
+func TestConnect__failover(t *testing.T) {
+	// an address with nothing listening on it
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	deadAddress := dead.Addr().String()
+	dead.Close()
+
+	setupWithConfig(t, Config{
+		URLs:       []string{deadAddress, ""},
+		Strategy:   StrategyFailover,
+		EjectAfter: 1,
+		Timeout:    time.Duration(5 * time.Second),
+	})
+	defer teardown()
+	assert.Equal(t, server.Address(), client.endpoint.url)
+	assert.True(t, client.endpoints.endpoints[0].ejected(time.Now()))
+}
+
+func TestNewTLSConfig__optionalCertAndCa(t *testing.T) {
+	tlsConfig, err := NewTLSConfig("", "", "")
+	assert.Nil(t, err)
+	assert.Empty(t, tlsConfig.Certificates)
+	// a nil RootCAs uses the system's CA pool
+	assert.Nil(t, tlsConfig.RootCAs)
+
+	_, err = NewTLSConfig("../test/fixtures/certs/logger.key", "", "")
+	assert.NotNil(t, err)
+}
+
+func TestWrite__plaintext(t *testing.T) {
+	var err error
+	server, err = tlstest.NewServer(nil)
+	assert.Nil(t, err)
+	client, err = NewClient(Config{
+		URLs:      []string{server.Address()},
+		Plaintext: true,
+		Timeout:   time.Duration(5 * time.Second),
+	})
+	assert.Nil(t, err)
+	defer teardown()
+
+	_, err = client.Write(referenceEvent())
+	assert.Nil(t, err)
+	assert.Nil(t, server.WaitForLines(1, time.Second))
+
+	_, err = NewClient(Config{
+		URLs:      []string{server.Address()},
+		Plaintext: true,
+		Ca:        "../test/fixtures/certs/ca.crt",
+	})
+	assert.NotNil(t, err)
+}
+
 func TestPeriodicDisconnect(t *testing.T) {
 	setup(t, time.Duration(5*time.Second))
 	defer teardown()
@@ -100,3 +224,185 @@ func TestPeriodicDisconnect(t *testing.T) {
 	client.Write(event)
 	assert.NotEqual(t, initialTime, client.lastConnectTime)
 }
+
+func TestParseTLSOptions(t *testing.T) {
+	opts, err := ParseTLSOptions("1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, "logstash", []string{"sha256/" + base64.StdEncoding.EncodeToString(make([]byte, 32))})
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), opts.MinVersion)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, opts.CipherSuites)
+	assert.Equal(t, 1, len(opts.PinnedSPKI))
+
+	_, err = ParseTLSOptions("2.0", nil, "", nil)
+	assert.NotNil(t, err)
+	_, err = ParseTLSOptions("", []string{"TLS_NOT_A_SUITE"}, "", nil)
+	assert.NotNil(t, err)
+	_, err = ParseTLSOptions("", []string{"TLS_AES_128_GCM_SHA256"}, "", nil)
+	assert.NotNil(t, err)
+	_, err = ParseTLSOptions("", nil, "", []string{"too short"})
+	assert.NotNil(t, err)
+}
+
+func spkiPin(t *testing.T, certFile string) []byte {
+	b, err := ioutil.ReadFile(certFile)
+	assert.Nil(t, err)
+	block, _ := pem.Decode(b)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	assert.Nil(t, err)
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+func TestWrite__pinnedSPKI(t *testing.T) {
+	setupWithConfig(t, Config{
+		Timeout:    time.Duration(5 * time.Second),
+		TLSOptions: TLSOptions{PinnedSPKI: [][]byte{spkiPin(t, "../test/fixtures/certs/ca.crt")}},
+	})
+	defer teardown()
+	_, err := client.Write(referenceEvent())
+	assert.Nil(t, err)
+
+	client.TLSOptions.PinnedSPKI = [][]byte{make([]byte, 32)}
+	client.tls.options = client.TLSOptions
+	_, err = client.dial(server.Address())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "1 pinned keys")
+	assert.Contains(t, err.Error(), "match none of the pinned SPKI hashes")
+}
+
+func TestDial__minVersion(t *testing.T) {
+	serverTLSConfig, err := makeTLSConfigFromFiles("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	serverTLSConfig.MaxVersion = tls.VersionTLS12
+	server, err = tlstest.NewServer(serverTLSConfig)
+	assert.Nil(t, err)
+	defer server.Close()
+
+	c, err := NewClient(Config{
+		URLs:       []string{server.Address()},
+		Ca:         "../test/fixtures/certs/ca.crt",
+		Timeout:    time.Duration(5 * time.Second),
+		TLSOptions: TLSOptions{MinVersion: tls.VersionTLS13},
+	})
+	assert.Nil(t, err)
+	_, err = c.dial(server.Address())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "TLS handshake failed (min version 1.3)")
+}
+
+func TestPeriodicDisconnect__resumesSession(t *testing.T) {
+	setup(t, time.Duration(5*time.Second))
+	defer teardown()
+	full, resumed := client.fullHandshakes.Count(), client.resumedHandshakes.Count()
+
+	// TLS 1.3 session tickets arrive after the handshake, so a few reconnects may be
+	// needed before one is resumed
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) && client.resumedHandshakes.Count() == resumed {
+		time.Sleep(50 * time.Millisecond)
+		client.lastConnectTime = time.Now().Add(-300 * time.Second)
+		_, err := client.Write(referenceEvent())
+		assert.Nil(t, err)
+	}
+	assert.True(t, client.resumedHandshakes.Count() > resumed)
+	assert.Equal(t, full, client.fullHandshakes.Count())
+
+	// a reload of the client's certs starts a new session
+	assert.Nil(t, client.tls.Reload())
+	client.lastConnectTime = time.Now().Add(-300 * time.Second)
+	client.Write(referenceEvent())
+	assert.Equal(t, full+1, client.fullHandshakes.Count())
+}
+
+func TestPeriodicDisconnect__jitter(t *testing.T) {
+	setupWithConfig(t, Config{
+		Timeout:         time.Duration(5 * time.Second),
+		ReconnectAge:    time.Duration(10 * time.Second),
+		ReconnectJitter: time.Duration(5 * time.Second),
+	})
+	defer teardown()
+	assert.True(t, client.connectionAge >= 10*time.Second)
+	assert.True(t, client.connectionAge < 15*time.Second)
+
+	// a connection younger than its age is kept
+	connectTime := time.Now().Add(-9 * time.Second)
+	client.lastConnectTime = connectTime
+	client.Write(referenceEvent())
+	assert.Equal(t, connectTime, client.lastConnectTime)
+}
+
+// partialConn writes only the first limit bytes of the first Write to its Conn, then
+// fails like a write that hit its deadline.
+type partialConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *partialConn) Write(b []byte) (int, error) {
+	n, _ := c.Conn.Write(b[:c.limit])
+	return n, errors.New("i/o timeout")
+}
+
+func TestWriteAndRetry__partialWrite(t *testing.T) {
+	setup(t, time.Duration(5*time.Second))
+	defer teardown()
+	partial := client.partialWrites.Count()
+
+	client.conn = &partialConn{Conn: client.conn, limit: len("one\ntwo\nth")}
+	n, err := client.writeAndRetry([]byte("one\ntwo\nthree\nfour\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, len("one\ntwo\nthree\nfour\n"), n)
+	assert.Equal(t, partial+1, client.partialWrites.Count())
+
+	// the truncated line arrives on the old connection, but whole lines are never
+	// sent twice and the truncated one is sent again in full
+	client.Close()
+	server.WaitForLines(5, time.Second)
+	count := map[string]int{}
+	for _, line := range server.Lines() {
+		count[line]++
+	}
+	assert.Equal(t, map[string]int{"one": 1, "two": 1, "th": 1, "three": 1, "four": 1}, count)
+}
+
+func TestWrite__batchFailsPartWay(t *testing.T) {
+	setupWithConfig(t, Config{
+		Timeout:        time.Duration(5 * time.Second),
+		BatchMaxEvents: 3,
+		Retry:          RetryPolicy{MaxAttempts: 1},
+	})
+	defer teardown()
+
+	events, lines := []*V1Event{}, []string{}
+	for _, msg := range []string{"one", "two", "three"} {
+		e := referenceEvent()
+		e.Message = msg
+		b, err := e.ToJSON()
+		assert.Nil(t, err)
+		events, lines = append(events, e), append(lines, string(b))
+	}
+	for _, e := range events[:2] {
+		_, err := client.Write(e)
+		assert.Nil(t, err)
+	}
+
+	// the batch fills, and the write fails in the third line
+	client.conn = &partialConn{Conn: client.conn, limit: len(lines[0]) + len(lines[1]) + 4}
+	_, err := client.Write(events[2])
+	assert.NotNil(t, err)
+	// the delivered lines are dropped from the batch, and the event written is removed
+	// again for the caller to retry
+	assert.Equal(t, 0, client.batchEvents)
+	assert.Empty(t, client.batch)
+
+	_, err = client.Write(events[2])
+	assert.Nil(t, err)
+	assert.Nil(t, client.Flush())
+	server.WaitForLines(4, time.Second)
+	count := map[string]int{}
+	for _, line := range server.Lines() {
+		count[line]++
+	}
+	assert.Equal(t, map[string]int{lines[0]: 1, lines[1]: 1, lines[2][:2]: 1, lines[2]: 1}, count)
+}
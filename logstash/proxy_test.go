@@ -0,0 +1,189 @@
+package logstash
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// proxyStandIn is an in-process proxy that accepts the credentials user:secret,
+// records the addresses it is asked to connect to, and relays the connections.
+type proxyStandIn struct {
+	listener  net.Listener
+	handshake func(net.Conn) (string, bool)
+
+	sync.Mutex
+	targets []string
+}
+
+func newProxyStandIn(t *testing.T, handshake func(net.Conn) (string, bool)) *proxyStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	p := &proxyStandIn{listener: l, handshake: handshake}
+	go p.run()
+	return p
+}
+
+func (p *proxyStandIn) run() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.relay(conn)
+	}
+}
+
+func (p *proxyStandIn) relay(conn net.Conn) {
+	defer conn.Close()
+	target, ok := p.handshake(conn)
+	if !ok {
+		return
+	}
+	p.Lock()
+	p.targets = append(p.targets, target)
+	p.Unlock()
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer upstream.Close()
+	go io.Copy(upstream, conn)
+	io.Copy(conn, upstream)
+}
+
+func (p *proxyStandIn) Targets() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string{}, p.targets...)
+}
+
+func (p *proxyStandIn) URL(scheme, password string) string {
+	return fmt.Sprintf("%s://user:%s@%s", scheme, password, p.listener.Addr())
+}
+
+func (p *proxyStandIn) Close() {
+	p.listener.Close()
+}
+
+func httpConnectHandshake(conn net.Conn) (string, bool) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil || req.Method != "CONNECT" {
+		return "", false
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return "", false
+	}
+	io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host, true
+}
+
+func socks5Handshake(conn net.Conn) (string, bool) {
+	read := func(n int) []byte {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return nil
+		}
+		return b
+	}
+
+	greeting := read(2)
+	if greeting == nil || greeting[0] != 5 {
+		return "", false
+	}
+	methods := read(int(greeting[1]))
+	if len(methods) != 1 || methods[0] != 2 {
+		conn.Write([]byte{5, 0xff})
+		return "", false
+	}
+	conn.Write([]byte{5, 2})
+	user := read(int(read(2)[1]))
+	password := read(int(read(1)[0]))
+	if string(user) != "user" || string(password) != "secret" {
+		conn.Write([]byte{1, 1})
+		return "", false
+	}
+	conn.Write([]byte{1, 0})
+
+	req := read(4)
+	var host string
+	switch req[3] {
+	case 1:
+		host = net.IP(read(net.IPv4len)).String()
+	case 3:
+		host = string(read(int(read(1)[0])))
+	case 4:
+		host = net.IP(read(net.IPv6len)).String()
+	}
+	port := binary.BigEndian.Uint16(read(2))
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), true
+}
+
+func TestWrite__proxy(t *testing.T) {
+	for scheme, handshake := range map[string]func(net.Conn) (string, bool){
+		"http":   httpConnectHandshake,
+		"socks5": socks5Handshake,
+	} {
+		proxy := newProxyStandIn(t, handshake)
+		setupWithConfig(t, Config{
+			Timeout: time.Duration(5 * time.Second),
+			Proxy:   proxy.URL(scheme, "secret"),
+		})
+
+		_, err := client.Write(referenceEvent())
+		assert.Nil(t, err, scheme)
+		assert.Nil(t, server.WaitForLines(1, time.Second), scheme)
+		assert.Equal(t, []string{server.Address()}, proxy.Targets(), scheme)
+
+		teardown()
+		proxy.Close()
+	}
+}
+
+func TestDial__proxyRejectsCredentials(t *testing.T) {
+	for scheme, handshake := range map[string]func(net.Conn) (string, bool){
+		"http":   httpConnectHandshake,
+		"socks5": socks5Handshake,
+	} {
+		proxy := newProxyStandIn(t, handshake)
+		setupWithConfig(t, Config{
+			Timeout: time.Duration(5 * time.Second),
+			Proxy:   proxy.URL(scheme, "secret"),
+		})
+
+		var err error
+		client.proxy, err = newProxyDialer(proxy.URL(scheme, "wrong"))
+		assert.Nil(t, err)
+		_, err = client.dial(server.Address())
+		assert.NotNil(t, err, scheme)
+		assert.Equal(t, causeConfig, classify(err), scheme)
+		assert.Len(t, proxy.Targets(), 1, scheme)
+
+		teardown()
+		proxy.Close()
+	}
+}
+
+func TestNewProxyDialer(t *testing.T) {
+	_, err := newProxyDialer("socks5://proxy:1080")
+	assert.Nil(t, err)
+
+	_, err = newProxyDialer("https://proxy:3128")
+	assert.NotNil(t, err)
+
+	_, err = newProxyDialer("http://proxy")
+	assert.NotNil(t, err)
+}
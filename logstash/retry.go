@@ -0,0 +1,166 @@
+package logstash
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Causes of failed connection attempts and writes. They decide whether a failure is
+// retried, and are reported by the <name>_retries.<cause> metrics, such as
+// logstash_retries.network.
+const (
+	// a transient network error, such as a refused connection, a reset or a timeout
+	causeNetwork = "network"
+	// the server's cert failed verification or pinning. Retried, since a reloaded CA
+	// bundle or another server may fix it.
+	causeTLSVerify = "tls_verify"
+	// any other failed TLS handshake, such as no common version or cipher suite, or
+	// the server rejecting the client cert
+	causeTLSHandshake = "tls_handshake"
+	// an error that retrying can't fix, such as a malformed address or credentials
+	// rejected by the proxy. Never retried.
+	causeConfig = "config"
+)
+
+// RetryPolicy controls how the Client, and other outputs through Do, retry failed
+// connection attempts and writes. Attempts are spaced by an exponential backoff that
+// starts at InitialInterval and grows by Multiplier up to MaxInterval, each interval
+// randomized by up to plus or minus Jitter of itself. Do gives up after MaxAttempts
+// attempts, or once MaxElapsed has passed, whichever comes first. Errors that
+// retrying can't fix are returned straight away.
+//
+// Zero fields take their value from DefaultRetryPolicy. A negative MaxElapsed retries
+// for ever, a zero MaxAttempts doesn't limit attempts, and a negative Jitter disables
+// randomization.
+type RetryPolicy struct {
+	MaxElapsed      time.Duration
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	Multiplier      float64
+	Jitter          float64
+}
+
+// DefaultRetryPolicy gives up after 15 minutes of failures.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxElapsed:      time.Duration(15) * time.Minute,
+	InitialInterval: time.Duration(500) * time.Millisecond,
+	MaxInterval:     time.Duration(60) * time.Second,
+	Multiplier:      1.5,
+	Jitter:          0.5,
+}
+
+// WithDefaults returns the policy with its zero fields taken from DefaultRetryPolicy.
+func (p RetryPolicy) WithDefaults() RetryPolicy {
+	if p.MaxElapsed == 0 {
+		p.MaxElapsed = DefaultRetryPolicy.MaxElapsed
+	}
+	if p.InitialInterval == 0 {
+		p.InitialInterval = DefaultRetryPolicy.InitialInterval
+	}
+	if p.MaxInterval == 0 {
+		p.MaxInterval = DefaultRetryPolicy.MaxInterval
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = DefaultRetryPolicy.Multiplier
+	}
+	if p.Jitter == 0 {
+		p.Jitter = DefaultRetryPolicy.Jitter
+	}
+	return p
+}
+
+// BackOff returns a backoff spacing attempts as the policy says. The policy's defaults
+// must have been applied.
+func (p RetryPolicy) BackOff() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = p.InitialInterval
+	b.MaxInterval = p.MaxInterval
+	b.Multiplier = p.Multiplier
+	b.RandomizationFactor = p.Jitter
+	if p.Jitter < 0 {
+		b.RandomizationFactor = 0
+	}
+	b.MaxElapsedTime = p.MaxElapsed
+	if p.MaxElapsed < 0 {
+		b.MaxElapsedTime = 0
+	}
+	b.Reset()
+	return b
+}
+
+// handshakeError is a failed TLS handshake, annotated with the TLSOptions in force.
+type handshakeError struct {
+	options TLSOptions
+	err     error
+}
+
+func (e *handshakeError) Error() string {
+	return fmt.Sprintf("TLS handshake failed (%s): %s", e.options, e.err)
+}
+
+func (e *handshakeError) Unwrap() error { return e.err }
+
+// classify returns the cause of an error returned by dial or write.
+func classify(err error) string {
+	var (
+		unknownAuthority x509.UnknownAuthorityError
+		invalidCert      x509.CertificateInvalidError
+		hostname         x509.HostnameError
+		pin              *pinError
+		handshake        *handshakeError
+		proxyAuth        *proxyAuthError
+		addrErr          *net.AddrError
+		parseErr         *net.ParseError
+		unknownNet       net.UnknownNetworkError
+	)
+	switch {
+	case errors.As(err, &unknownAuthority), errors.As(err, &invalidCert), errors.As(err, &hostname), errors.As(err, &pin):
+		return causeTLSVerify
+	case errors.As(err, &handshake):
+		return causeTLSHandshake
+	case errors.As(err, &proxyAuth), errors.As(err, &addrErr), errors.As(err, &parseErr), errors.As(err, &unknownNet):
+		return causeConfig
+	default:
+		return causeNetwork
+	}
+}
+
+// Do calls op until it succeeds, returns an error that retrying can't fix, or the
+// policy gives up. Each retry is counted by the <name>_retries.<cause> metric.
+func (p RetryPolicy) Do(name string, op func() error) error {
+	p = p.WithDefaults()
+	b := p.BackOff()
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil {
+			return nil
+		}
+		cause := classify(err)
+		if cause == causeConfig {
+			return err
+		}
+		if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			return fmt.Errorf("giving up after %s: %w", p.MaxElapsed, err)
+		}
+		metrics.GetOrRegisterCounter(name+"_retries."+cause, metrics.DefaultRegistry).Inc(1)
+		log.Printf("Retrying %s in %s after %s error", name, next, cause)
+		time.Sleep(next)
+	}
+}
+
+// retry calls op as allowed by the retry policy.
+func (c *Client) retry(op func() error) error {
+	return c.Retry.Do("logstash", op)
+}
@@ -0,0 +1,73 @@
+package logstash
+
+import (
+	"crypto/x509"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClassify(t *testing.T) {
+	assert.Equal(t, causeNetwork, classify(&net.OpError{Op: "dial", Err: errors.New("connection refused")}))
+	assert.Equal(t, causeTLSVerify, classify(&handshakeError{err: x509.UnknownAuthorityError{}}))
+	assert.Equal(t, causeTLSVerify, classify(&handshakeError{err: &pinError{}}))
+	assert.Equal(t, causeTLSHandshake, classify(&handshakeError{err: errors.New("tls: protocol version not supported")}))
+	assert.Equal(t, causeConfig, classify(&net.OpError{Op: "dial", Err: &net.AddrError{Err: "missing port in address"}}))
+}
+
+func TestRetry(t *testing.T) {
+	c := &Client{Config: Config{Retry: RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: time.Millisecond,
+	}.WithDefaults()}}
+	retries := metrics.GetOrRegisterCounter("logstash_retries.network", metrics.DefaultRegistry)
+	before := retries.Count()
+
+	// transient errors are retried until the policy gives up
+	attempts := 0
+	err := c.retry(func() error {
+		attempts++
+		return errors.New("connection reset")
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, before+2, retries.Count())
+
+	attempts = 0
+	err = c.retry(func() error {
+		attempts++
+		if attempts < 2 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+
+	// config errors are never retried
+	attempts = 0
+	err = c.retry(func() error {
+		attempts++
+		return &net.AddrError{Err: "missing port in address"}
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, attempts)
+}
+
+func TestRetry__maxElapsed(t *testing.T) {
+	c := &Client{Config: Config{Retry: RetryPolicy{
+		MaxElapsed:      50 * time.Millisecond,
+		InitialInterval: 10 * time.Millisecond,
+		MaxInterval:     10 * time.Millisecond,
+		Jitter:          -1,
+	}.WithDefaults()}}
+	start := time.Now()
+	err := c.retry(func() error { return errors.New("connection reset") })
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "giving up after 50ms")
+	assert.True(t, time.Since(start) < time.Second)
+}
@@ -0,0 +1,74 @@
+package logstash
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+var (
+	// used when Config.SRVRefresh is not set
+	defaultSRVRefresh = time.Duration(5) * time.Minute
+)
+
+// LookupSRVFunc looks up the SRV records for a service. It has the signature of
+// net.LookupSRV, which is used when Config.LookupSRV is nil.
+type LookupSRVFunc func(service, proto, name string) (cname string, addrs []*net.SRV, err error)
+
+// refreshSRV is called before each batch is written. It resolves the SRV record again
+// if it is due, so a long-lived connection doesn't keep the record from being
+// refreshed, and closes the connection if its server is no longer a target, so that
+// the batch is written to one that is.
+func (c *Client) refreshSRV() {
+	if c.SRV == "" || c.conn == nil {
+		return
+	}
+	if err := c.refreshEndpoints(); err != nil {
+		return
+	}
+	for _, e := range c.endpoints.endpoints {
+		if e == c.endpoint {
+			return
+		}
+	}
+	log.Printf("Logstash server %s is no longer a target of SRV record %s, reconnecting", c.endpoint.url, c.SRV)
+	c.Close()
+}
+
+// refreshEndpoints resolves the SRV record in Config.SRV and replaces the endpoints in
+// the pool with its targets if it is due to be resolved again. If resolution fails the
+// last known good set of endpoints is kept, and an error is only returned if there is
+// no such set.
+func (c *Client) refreshEndpoints() error {
+	if c.SRV == "" {
+		return nil
+	}
+	if !c.srvStale && time.Since(c.lastResolve) < c.SRVRefresh && len(c.endpoints.endpoints) > 0 {
+		return nil
+	}
+
+	_, records, err := c.LookupSRV("", "", c.SRV)
+	if err == nil && len(records) == 0 {
+		err = errors.New("no records found")
+	}
+	if err != nil {
+		if len(c.endpoints.endpoints) == 0 {
+			return fmt.Errorf("Unable to resolve SRV record %s: %s", c.SRV, err)
+		}
+		log.Printf("Unable to resolve SRV record %s, using the last known servers: %s", c.SRV, err)
+		c.lastResolve = time.Now()
+		c.srvStale = false
+		return nil
+	}
+
+	before := c.endpoints.urls()
+	c.endpoints.update(records)
+	c.lastResolve = time.Now()
+	c.srvStale = false
+	if after := c.endpoints.urls(); after != before {
+		log.Printf("Resolved SRV record %s: %s", c.SRV, after)
+	}
+	return nil
+}
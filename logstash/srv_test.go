@@ -0,0 +1,135 @@
+package logstash
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver answers SRV lookups with records, or err if it is set, and counts lookups.
+type fakeResolver struct {
+	records []*net.SRV
+	err     error
+	lookups int
+}
+
+func (r *fakeResolver) LookupSRV(service, proto, name string) (string, []*net.SRV, error) {
+	r.lookups++
+	return name, r.records, r.err
+}
+
+func newSRVClient(t *testing.T, r *fakeResolver) *Client {
+	c, err := NewClient(Config{
+		SRV:       "_logstash._tcp.example.com",
+		LookupSRV: r.LookupSRV,
+		Key:       "../test/fixtures/certs/logger.key",
+		Cert:      "../test/fixtures/certs/logger.crt",
+		Ca:        "../test/fixtures/certs/ca.crt",
+	})
+	assert.Nil(t, err)
+	return c
+}
+
+func TestNewClient__urlsAndSRV(t *testing.T) {
+	_, err := NewClient(Config{
+		URLs: []string{"a:1"},
+		SRV:  "_logstash._tcp.example.com",
+		Key:  "../test/fixtures/certs/logger.key",
+		Cert: "../test/fixtures/certs/logger.crt",
+		Ca:   "../test/fixtures/certs/ca.crt",
+	})
+	assert.NotNil(t, err)
+}
+
+func TestRefreshEndpoints__priorityAndWeight(t *testing.T) {
+	r := &fakeResolver{records: []*net.SRV{
+		{Target: "backup.example.com.", Port: 4000, Priority: 20, Weight: 100},
+		{Target: "light.example.com.", Port: 4000, Priority: 10, Weight: 0},
+		{Target: "heavy.example.com.", Port: 4001, Priority: 10, Weight: 100},
+	}}
+	c := newSRVClient(t, r)
+	assert.Nil(t, c.refreshEndpoints())
+
+	// the zero-weight target of the lowest priority is rarely chosen over a weighted
+	// one, but it is chosen
+	c.endpoints.rand = rand.New(rand.NewSource(1))
+	picks := map[string]int{}
+	for i := 0; i < 2000; i++ {
+		picks[c.endpoints.pick().url]++
+	}
+	assert.True(t, picks["light.example.com:4000"] > 0)
+	assert.True(t, picks["light.example.com:4000"] < 100)
+	assert.Equal(t, 2000, picks["light.example.com:4000"]+picks["heavy.example.com:4001"])
+
+	// the next priority is only used once the lowest priority targets are ejected
+	now := time.Now()
+	for _, e := range c.endpoints.endpoints {
+		if e.priority == 10 {
+			e.ejectedUntil = now.Add(time.Hour)
+		}
+	}
+	assert.Equal(t, "backup.example.com:4000", c.endpoints.pick().url)
+}
+
+func TestRefreshEndpoints__lastKnownGood(t *testing.T) {
+	r := &fakeResolver{err: errors.New("SERVFAIL")}
+	c := newSRVClient(t, r)
+
+	// nothing to fall back to
+	assert.NotNil(t, c.refreshEndpoints())
+
+	r.err = nil
+	r.records = []*net.SRV{{Target: "a.example.com.", Port: 4000}}
+	assert.Nil(t, c.refreshEndpoints())
+
+	// not due for a refresh yet
+	assert.Nil(t, c.refreshEndpoints())
+	assert.Equal(t, 2, r.lookups)
+
+	// a failed connection forces a refresh, and a failed refresh keeps the last set
+	c.srvStale = true
+	r.err = errors.New("SERVFAIL")
+	assert.Nil(t, c.refreshEndpoints())
+	assert.Equal(t, 3, r.lookups)
+	assert.Equal(t, "a.example.com:4000", c.endpoints.urls())
+}
+
+func TestRefreshEndpoints__keepsHealthHistory(t *testing.T) {
+	r := &fakeResolver{records: []*net.SRV{{Target: "a.example.com.", Port: 4000}}}
+	c := newSRVClient(t, r)
+	assert.Nil(t, c.refreshEndpoints())
+	c.endpoints.connectFailure(c.endpoints.endpoints[0])
+
+	r.records = append(r.records, &net.SRV{Target: "b.example.com.", Port: 4000})
+	c.srvStale = true
+	assert.Nil(t, c.refreshEndpoints())
+	assert.Equal(t, 2, len(c.endpoints.endpoints))
+	assert.Equal(t, 1, c.endpoints.endpoints[0].failures)
+}
+
+func TestRefreshSRV__reconnectsToCurrentTargets(t *testing.T) {
+	r := &fakeResolver{records: []*net.SRV{{Target: "a.example.com.", Port: 4000}}}
+	c := newSRVClient(t, r)
+	assert.Nil(t, c.refreshEndpoints())
+	conn, server := net.Pipe()
+	defer server.Close()
+	c.conn = conn
+	c.endpoint = c.endpoints.endpoints[0]
+
+	// not due for a refresh yet
+	r.records = []*net.SRV{{Target: "b.example.com.", Port: 4000}}
+	c.refreshSRV()
+	assert.Equal(t, 1, r.lookups)
+	assert.NotNil(t, c.conn)
+
+	// once due, the record is resolved while connected, and the connection to a server
+	// that is no longer a target is closed
+	c.lastResolve = time.Now().Add(-c.SRVRefresh)
+	c.refreshSRV()
+	assert.Equal(t, 2, r.lookups)
+	assert.Nil(t, c.conn)
+}
@@ -0,0 +1,141 @@
+package logstash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// TLSOptions restrict the TLS connections made to servers beyond Go's defaults.
+type TLSOptions struct {
+	// MinVersion is the lowest TLS version accepted, or Go's default if zero.
+	MinVersion uint16
+	// CipherSuites are the TLS 1.0-1.2 cipher suites offered, or Go's defaults if
+	// empty. TLS 1.3 suites are not configurable.
+	CipherSuites []uint16
+	// ServerName overrides the name sent with SNI and verified against the server's
+	// cert, for connecting to servers by IP address.
+	ServerName string
+	// PinnedSPKI are SHA-256 hashes of public keys. If any are set, the server's
+	// verified chain must contain one of them.
+	PinnedSPKI [][]byte
+}
+
+// ParseTLSOptions returns the TLSOptions for a minimum version such as "1.2", cipher
+// suite names such as "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", a server name and
+// base64 encoded SHA-256 SPKI hashes, as used by HPKP's pin-sha256. Empty values
+// leave Go's defaults in place.
+func ParseTLSOptions(minVersion string, cipherSuites []string, serverName string, pins []string) (TLSOptions, error) {
+	opts := TLSOptions{ServerName: serverName}
+
+	if minVersion != "" {
+		v, ok := tlsVersions[minVersion]
+		if !ok {
+			return opts, fmt.Errorf("unknown TLS version: %s", minVersion)
+		}
+		opts.MinVersion = v
+	}
+
+	suites := map[string]*tls.CipherSuite{}
+	for _, s := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[s.Name] = s
+	}
+	for _, name := range cipherSuites {
+		s, ok := suites[name]
+		if !ok {
+			return opts, fmt.Errorf("unknown TLS cipher suite: %s", name)
+		}
+		if len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13 {
+			return opts, fmt.Errorf("TLS 1.3 cipher suites are not configurable: %s", name)
+		}
+		opts.CipherSuites = append(opts.CipherSuites, s.ID)
+	}
+
+	for _, pin := range pins {
+		hash, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if err != nil || len(hash) != sha256.Size {
+			return opts, fmt.Errorf("invalid SPKI pin, expected a base64 encoded SHA-256 hash: %s", pin)
+		}
+		opts.PinnedSPKI = append(opts.PinnedSPKI, hash)
+	}
+	return opts, nil
+}
+
+// isSet returns true if any option differs from Go's defaults.
+func (o TLSOptions) isSet() bool {
+	return o.MinVersion != 0 || len(o.CipherSuites) > 0 || o.ServerName != "" || len(o.PinnedSPKI) > 0
+}
+
+// apply sets the options on cfg.
+func (o TLSOptions) apply(cfg *tls.Config) {
+	cfg.MinVersion = o.MinVersion
+	cfg.CipherSuites = o.CipherSuites
+	cfg.ServerName = o.ServerName
+	if len(o.PinnedSPKI) > 0 {
+		cfg.VerifyConnection = o.verifyPins
+	}
+}
+
+// verifyPins runs after the server's chain has been verified, including on resumed
+// sessions, and rejects it unless one of its certs has a pinned public key.
+func (o TLSOptions) verifyPins(state tls.ConnectionState) error {
+	seen := []string{}
+	for _, chain := range state.VerifiedChains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range o.PinnedSPKI {
+				if bytes.Equal(hash[:], pin) {
+					return nil
+				}
+			}
+			seen = append(seen, "sha256/"+base64.StdEncoding.EncodeToString(hash[:]))
+		}
+	}
+	return &pinError{seen: seen}
+}
+
+// pinError is returned when none of the server's public keys is pinned.
+type pinError struct {
+	seen []string
+}
+
+func (e *pinError) Error() string {
+	return fmt.Sprintf("server's public keys match none of the pinned SPKI hashes, got %s", strings.Join(e.seen, ", "))
+}
+
+// String describes the options for error messages.
+func (o TLSOptions) String() string {
+	policy := []string{}
+	for name, v := range tlsVersions {
+		if v == o.MinVersion {
+			policy = append(policy, "min version "+name)
+		}
+	}
+	if len(o.CipherSuites) > 0 {
+		names := []string{}
+		for _, id := range o.CipherSuites {
+			names = append(names, tls.CipherSuiteName(id))
+		}
+		policy = append(policy, "cipher suites "+strings.Join(names, ","))
+	}
+	if o.ServerName != "" {
+		policy = append(policy, "server name "+o.ServerName)
+	}
+	if len(o.PinnedSPKI) > 0 {
+		policy = append(policy, fmt.Sprintf("%d pinned keys", len(o.PinnedSPKI)))
+	}
+	if len(policy) == 0 {
+		return "default policy"
+	}
+	return strings.Join(policy, ", ")
+}
@@ -0,0 +1,275 @@
+package logstash
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log"
+	"math/big"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// TLSReloader holds a client key, cert and CA bundle loaded from TLSFiles, and loads them
+// again when the files change or the process receives SIGHUP. Connections made with a
+// *tls.Config from Config or SharedConfig use the material that was current when they
+// were dialed, so renewed certs take effect on the next reconnect without a restart.
+type TLSReloader struct {
+	files   TLSFiles
+	options TLSOptions
+
+	sync.RWMutex
+	cert       *tls.Certificate
+	roots      *x509.CertPool
+	modTimes   []time.Time
+	generation int
+	reloaderMetrics
+}
+
+type reloaderMetrics struct {
+	reloads      metrics.Counter
+	reloadErrors metrics.Counter
+	certSerial   metrics.Gauge
+	certNotAfter metrics.Gauge
+}
+
+// NewTLSReloader loads files and returns an error if they can't be loaded. The configs
+// it returns are restricted by opts.
+func NewTLSReloader(files TLSFiles, opts TLSOptions) (*TLSReloader, error) {
+	files = files.resolve()
+	if err := files.validate(); err != nil {
+		return nil, err
+	}
+	r := &TLSReloader{
+		files:   files,
+		options: opts,
+		reloaderMetrics: reloaderMetrics{
+			reloads:      metrics.GetOrRegisterCounter("tls_reloads", metrics.DefaultRegistry),
+			reloadErrors: metrics.GetOrRegisterCounter("tls_reload_errors", metrics.DefaultRegistry),
+			certSerial:   metrics.GetOrRegisterGauge("tls_cert_serial", metrics.DefaultRegistry),
+			certNotAfter: metrics.GetOrRegisterGauge("tls_cert_not_after", metrics.DefaultRegistry),
+		},
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Config returns a *tls.Config that trusts the currently loaded CA bundle, or the
+// system's pool if there is none, and presents the client cert that is loaded at the
+// time of each handshake.
+func (r *TLSReloader) Config() *tls.Config {
+	r.RLock()
+	defer r.RUnlock()
+	cfg := &tls.Config{RootCAs: r.roots}
+	r.options.apply(cfg)
+	if r.cert != nil {
+		cfg.GetClientCertificate = r.clientCertificate
+	}
+	return cfg
+}
+
+// SharedConfig returns a *tls.Config for clients, such as an http.Transport, that keep
+// one config for every connection rather than asking Config for each. It presents the
+// client cert, and verifies the server against the CA bundle, loaded at the time of
+// each handshake.
+//
+// A handshake with a server dialed by IP address doesn't say which address that was,
+// so unless TLSOptions.ServerName is set, such a server is only accepted if it was
+// dialed with a config from ConfigForHost.
+func (r *TLSReloader) SharedConfig() *tls.Config {
+	cfg := r.Config()
+	cfg.RootCAs = nil
+	// verification by the handshake would use the CA bundle loaded now
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = r.verifyConnection
+	return cfg
+}
+
+// ConfigForHost returns a copy of cfg for a connection to host, with ServerName set to
+// host unless it is set already, as tls.Dial would. A VerifyConnection callback, such
+// as SharedConfig's, is told the server name even when host is an IP address, which
+// the handshake leaves out.
+func ConfigForHost(cfg *tls.Config, host string) *tls.Config {
+	cfg = cfg.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	if verify := cfg.VerifyConnection; verify != nil {
+		serverName := cfg.ServerName
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			if state.ServerName == "" {
+				state.ServerName = serverName
+			}
+			return verify(state)
+		}
+	}
+	return cfg
+}
+
+// verifyConnection verifies the server's chain as a handshake would with the currently
+// loaded CA bundle, and checks any pinned keys.
+func (r *TLSReloader) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server presented no certificate")
+	}
+	r.RLock()
+	roots := r.roots
+	r.RUnlock()
+	leaf := state.PeerCertificates[0]
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+		DNSName:       state.ServerName,
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if opts.DNSName == "" {
+		return errors.New("no server name to verify the server's cert against")
+	}
+	chains, err := leaf.Verify(opts)
+	if err != nil {
+		return err
+	}
+	if len(r.options.PinnedSPKI) > 0 {
+		state.VerifiedChains = chains
+		return r.options.verifyPins(state)
+	}
+	return nil
+}
+
+// Generation returns a number that changes every time the files are reloaded.
+func (r *TLSReloader) Generation() int {
+	r.RLock()
+	defer r.RUnlock()
+	return r.generation
+}
+
+func (r *TLSReloader) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.cert, nil
+}
+
+// Reload loads the key, cert and CA files again. If any of them can't be loaded the
+// previously loaded material is kept and an error returned.
+func (r *TLSReloader) Reload() error {
+	modTimes := r.currentModTimes()
+	cert, roots, err := r.files.load()
+	if err != nil {
+		r.reloadErrors.Inc(1)
+		return err
+	}
+	var leaf *x509.Certificate
+	if cert != nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			r.reloadErrors.Inc(1)
+			return err
+		}
+	}
+
+	r.Lock()
+	r.cert = cert
+	r.roots = roots
+	r.modTimes = modTimes
+	r.generation++
+	r.Unlock()
+	r.reloads.Inc(1)
+
+	if leaf != nil {
+		log.Printf("Loaded TLS client cert %s: serial %s, expires %s", r.files.certSource(), leaf.SerialNumber, leaf.NotAfter)
+		r.certSerial.Update(gaugeSerial(leaf.SerialNumber))
+		r.certNotAfter.Update(leaf.NotAfter.Unix())
+	}
+	return nil
+}
+
+// Watch reloads the files whenever the process receives SIGHUP and, if interval is
+// positive, when one of their modification times changes, checking every interval. It
+// returns immediately, with a func that stops watching.
+func (r *TLSReloader) Watch(interval time.Duration) (stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-hup:
+				log.Printf("Received SIGHUP, reloading TLS keys and certs")
+			case <-tick:
+				if !r.changed() {
+					continue
+				}
+				log.Printf("TLS key or cert files changed, reloading")
+			}
+			if err := r.Reload(); err != nil {
+				log.Printf("Error reloading TLS keys and certs, keeping the current ones: %s", err)
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(hup)
+			if ticker != nil {
+				ticker.Stop()
+			}
+			close(done)
+		})
+	}
+}
+
+// changed returns true if the modification time of any of the files differs from when
+// they were last loaded successfully.
+func (r *TLSReloader) changed() bool {
+	current := r.currentModTimes()
+	r.RLock()
+	defer r.RUnlock()
+	for i := range current {
+		if !current[i].Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *TLSReloader) currentModTimes() []time.Time {
+	times := []time.Time{}
+	for _, f := range r.files.paths() {
+		var t time.Time
+		if f != "" {
+			if fi, err := os.Stat(f); err == nil {
+				t = fi.ModTime()
+			}
+		}
+		times = append(times, t)
+	}
+	return times
+}
+
+// gaugeSerial fits a cert serial number into a gauge, keeping its low 63 bits if it is
+// too large. Serials are usually random, so this is still enough to tell certs apart.
+func gaugeSerial(serial *big.Int) int64 {
+	if serial.BitLen() < 64 {
+		return serial.Int64()
+	}
+	mask := new(big.Int).SetUint64(1<<63 - 1)
+	return new(big.Int).And(serial, mask).Int64()
+}
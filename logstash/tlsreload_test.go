@@ -0,0 +1,144 @@
+package logstash
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// copyFixture copies a fixture cert or key to dst.
+func copyFixture(t *testing.T, name, dst string) {
+	b, err := ioutil.ReadFile(filepath.Join("../test/fixtures/certs", name))
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(dst, b, 0600))
+}
+
+func clientCertCN(t *testing.T, r *TLSReloader) string {
+	cert, err := r.Config().GetClientCertificate(nil)
+	assert.Nil(t, err)
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.Nil(t, err)
+	return leaf.Subject.CommonName
+}
+
+func TestTLSReloader__reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_2_logstash_tls_tests")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	key, cert := filepath.Join(dir, "client.key"), filepath.Join(dir, "client.crt")
+	copyFixture(t, "logger.key", key)
+	copyFixture(t, "logger.crt", cert)
+
+	r, err := NewTLSReloader(TLSFiles{Key: key, Cert: cert, Ca: "../test/fixtures/certs/ca.crt"}, TLSOptions{})
+	assert.Nil(t, err)
+	assert.NotNil(t, r.Config().RootCAs)
+	before := clientCertCN(t, r)
+	assert.False(t, r.changed())
+	assert.NotZero(t, r.certNotAfter.Value())
+
+	// a config handed out before the reload presents the new cert too
+	cfg := r.Config()
+	copyFixture(t, "logstash.key", key)
+	copyFixture(t, "logstash.crt", cert)
+	future := time.Now().Add(time.Hour)
+	assert.Nil(t, os.Chtimes(cert, future, future))
+	assert.True(t, r.changed())
+	assert.Nil(t, r.Reload())
+	assert.False(t, r.changed())
+	after := clientCertCN(t, r)
+	assert.NotEqual(t, before, after)
+	current, err := cfg.GetClientCertificate(nil)
+	assert.Nil(t, err)
+	leaf, _ := x509.ParseCertificate(current.Certificate[0])
+	assert.Equal(t, after, leaf.Subject.CommonName)
+
+	// a broken cert is rejected and the current one kept
+	assert.Nil(t, ioutil.WriteFile(cert, []byte("not a cert"), 0600))
+	assert.NotNil(t, r.Reload())
+	assert.Equal(t, after, clientCertCN(t, r))
+}
+
+func TestNewTLSReloader__withoutClientCert(t *testing.T) {
+	r, err := NewTLSReloader(TLSFiles{}, TLSOptions{})
+	assert.Nil(t, err)
+	cfg := r.Config()
+	assert.Nil(t, cfg.GetClientCertificate)
+	assert.Nil(t, cfg.RootCAs)
+
+	_, err = NewTLSReloader(TLSFiles{Key: "../test/fixtures/certs/logger.key"}, TLSOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestTLSReloader__sharedConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal_2_logstash_tls_tests")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	// a bundle that doesn't hold the CA which signed the server's cert
+	ca := filepath.Join(dir, "ca.crt")
+	copyFixture(t, "logger.crt", ca)
+
+	serverTLSConfig, err := NewTLSConfig("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	dial := func(cfg *tls.Config) error {
+		conn, err := tls.Dial("tcp", l.Addr().String(), cfg)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	r, err := NewTLSReloader(TLSFiles{Ca: ca}, TLSOptions{})
+	assert.Nil(t, err)
+	cfg := ConfigForHost(r.SharedConfig(), "127.0.0.1")
+	var unknownAuthority x509.UnknownAuthorityError
+	assert.True(t, errors.As(dial(cfg), &unknownAuthority))
+
+	// the same config trusts the reloaded bundle
+	copyFixture(t, "ca.crt", ca)
+	assert.Nil(t, r.Reload())
+	assert.Nil(t, dial(cfg))
+
+	// the server was dialed by IP address, so without ConfigForHost its cert can't be
+	// checked, and with it the cert is checked against the host that was dialed
+	assert.NotNil(t, dial(r.SharedConfig()))
+	var hostname x509.HostnameError
+	assert.True(t, errors.As(dial(ConfigForHost(r.SharedConfig(), "10.0.0.1")), &hostname))
+}
+
+func TestTLSReloader__watch(t *testing.T) {
+	r, err := NewTLSReloader(TLSFiles{Ca: "../test/fixtures/certs/ca.crt"}, TLSOptions{})
+	assert.Nil(t, err)
+	stop := r.Watch(0)
+	defer stop()
+
+	// without periodic checks SIGHUP still reloads, rather than ending the process
+	before := r.Generation()
+	assert.Nil(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	for i := 0; i < 100 && r.Generation() == before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotEqual(t, before, r.Generation())
+}
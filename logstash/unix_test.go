@@ -0,0 +1,117 @@
+package logstash
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func socketPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "j2l-unix")
+	assert.Nil(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "relay.sock")
+}
+
+func TestWrite__unix(t *testing.T) {
+	path := socketPath(t)
+	l, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer l.Close()
+	lines := make(chan string, 3)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+
+	c, err := NewClient(Config{URLs: []string{path}, Network: NetworkUnix, Plaintext: true, Timeout: 5 * time.Second, BatchMaxEvents: 3})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		_, err := c.Write(referenceEvent())
+		assert.Nil(t, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case line := <-lines:
+			assert.Contains(t, line, `"message":"foo"`)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for line")
+		}
+	}
+}
+
+func TestWrite__unixgram(t *testing.T) {
+	path := socketPath(t)
+	listen := func() *net.UnixConn {
+		conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+		assert.Nil(t, err)
+		return conn
+	}
+	readDatagram := func(conn *net.UnixConn) string {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 65536)
+		n, err := conn.Read(buf)
+		assert.Nil(t, err)
+		return string(buf[:n])
+	}
+	relay := listen()
+
+	c, err := NewClient(Config{
+		URLs:           []string{path},
+		Network:        NetworkUnixgram,
+		Plaintext:      true,
+		Timeout:        5 * time.Second,
+		BatchMaxEvents: 2,
+		Retry:          RetryPolicy{InitialInterval: 10 * time.Millisecond},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+	defer c.Close()
+
+	// each line of a batch is a datagram of its own
+	c.Write(referenceEvent())
+	_, err = c.Write(referenceEvent())
+	assert.Nil(t, err)
+	for i := 0; i < 2; i++ {
+		msg := readDatagram(relay)
+		assert.Contains(t, msg, `"message":"foo"`)
+		assert.Equal(t, byte('\n'), msg[len(msg)-1])
+		assert.Equal(t, 1, strings.Count(msg, "\n"))
+	}
+
+	// the client reconnects when the relay is restarted
+	relay.Close()
+	os.Remove(path)
+	relay = listen()
+	defer relay.Close()
+	c.Write(referenceEvent())
+	_, err = c.Write(referenceEvent())
+	assert.Nil(t, err)
+	assert.Contains(t, readDatagram(relay), `"message":"foo"`)
+}
+
+func TestNewClient__unixNetwork(t *testing.T) {
+	_, err := NewClient(Config{URLs: []string{"/run/relay.sock"}, Network: NetworkUnix})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URLs: []string{"/run/relay.sock"}, Network: NetworkUnix, Plaintext: true, Proxy: "socks5://proxy:1080"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URLs: []string{"relay:5000"}, Network: "udp", Plaintext: true})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,213 @@
+// Package logstashhttp implements an output that POSTs batches of events to
+// logstash-input-http, typically behind an HTTPS load balancer.
+//
+// Each batch is sent as newline delimited JSON with the Content-Type
+// application/x-ndjson, optionally gzip compressed. The input must decode that
+// content type as JSON lines:
+//
+//	input {
+//	  http {
+//	    additional_codecs => { "application/x-ndjson" => "json_lines" }
+//	  }
+//	}
+package logstashhttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/httpoutput"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	defaultBatchMaxEvents = 500
+	defaultBatchMaxBytes  = 1 << 20
+)
+
+// Config holds the settings for a logstash HTTP Client.
+type Config struct {
+	// URLs are the URLs events are POSTed to, such as https://logstash:8080. Batches go
+	// to the first URL, moving on to the next after a failure.
+	URLs []string
+	// TLSConfig is used for https URLs, or Go's defaults if nil.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// BatchMaxEvents and BatchMaxBytes limit the size of a batch, before compression.
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	// CompressionLevel is the gzip level used to compress each batch. 0 disables
+	// compression.
+	CompressionLevel int
+	// Retry is how a failed batch is retried before Flush gives up.
+	Retry logstash.RetryPolicy
+}
+
+// Client POSTs Logstash V1Events to logstash-input-http.
+//
+// Write adds events to a batch, which is sent once it is full. Flush sends a partially
+// filled batch. A batch is only delivered once the server has answered 2xx; responses
+// 429 and 5xx, and network errors, are retried, while other responses fail the batch.
+type Client struct {
+	Config
+	sender  *httpoutput.Sender
+	url     int
+	pending bytes.Buffer
+	events  int
+	lastErr error
+	clientMetrics
+}
+
+type clientMetrics struct {
+	requests  metrics.Counter
+	retries   metrics.Counter
+	batchSize metrics.Histogram
+}
+
+// NewClient returns a Client object. Connections are made when the first batch is sent.
+func NewClient(cfg Config) (*Client, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, errors.New("at least one logstash HTTP URL is required")
+	}
+	for _, u := range cfg.URLs {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("logstash HTTP URL must start with http:// or https://: %s", u)
+		}
+	}
+	if cfg.CompressionLevel < gzip.NoCompression || cfg.CompressionLevel > gzip.BestCompression {
+		return nil, fmt.Errorf("invalid compression level: %d", cfg.CompressionLevel)
+	}
+	if cfg.BatchMaxEvents == 0 {
+		cfg.BatchMaxEvents = defaultBatchMaxEvents
+	}
+	if cfg.BatchMaxBytes == 0 {
+		cfg.BatchMaxBytes = defaultBatchMaxBytes
+	}
+
+	c := &Client{
+		Config: cfg,
+		sender: httpoutput.NewSender(httpoutput.Config{
+			Name:        "logstash",
+			TLSConfig:   cfg.TLSConfig,
+			Timeout:     cfg.Timeout,
+			RetryPolicy: cfg.Retry,
+		}),
+		clientMetrics: clientMetrics{
+			requests:  metrics.GetOrRegisterCounter("logstash_http_requests", metrics.DefaultRegistry),
+			retries:   metrics.GetOrRegisterCounter("logstash_http_retries", metrics.DefaultRegistry),
+			batchSize: metrics.GetOrRegisterHistogram("logstash_http_batch_size", metrics.DefaultRegistry, metrics.NewUniformSample(1028)),
+		},
+	}
+	return c, nil
+}
+
+// Open does nothing, since connections are made as batches are sent.
+func (c *Client) Open() error {
+	return nil
+}
+
+// Write adds an event to the current batch, and sends the batch if it is full. If
+// sending fails the event is removed from the batch again, so that the caller may
+// retry the Write.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	b, err := e.ToJSON()
+	if err != nil {
+		return 0, err
+	}
+	mark := c.pending.Len()
+	c.pending.Write(b)
+	c.pending.WriteByte('\n')
+	c.events++
+	if c.events >= c.BatchMaxEvents || c.pending.Len() >= c.BatchMaxBytes {
+		if err := c.Flush(); err != nil {
+			c.pending.Truncate(mark)
+			c.events--
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends the current batch and blocks until the server has accepted it.
+func (c *Client) Flush() error {
+	if c.events == 0 {
+		return nil
+	}
+	body, err := c.encode()
+	if err != nil {
+		return err
+	}
+
+	err = c.sender.Retry(func() error {
+		return c.post(body)
+	}, func(error) {
+		c.url = (c.url + 1) % len(c.URLs)
+		c.retries.Inc(1)
+	})
+	c.lastErr = err
+	if err != nil {
+		return err
+	}
+	c.batchSize.Update(int64(c.events))
+	c.pending.Reset()
+	c.events = 0
+	return nil
+}
+
+// Close discards any events that have not been sent.
+func (c *Client) Close() error {
+	c.pending.Reset()
+	c.events = 0
+	return nil
+}
+
+// Health returns the error of the last batch that failed for good, if no batch has
+// been delivered since.
+func (c *Client) Health() error {
+	return c.lastErr
+}
+
+// encode returns the current batch, compressed if compression is enabled.
+func (c *Client) encode() ([]byte, error) {
+	if c.CompressionLevel == gzip.NoCompression {
+		return c.pending.Bytes(), nil
+	}
+	var compressed bytes.Buffer
+	w, err := gzip.NewWriterLevel(&compressed, c.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(c.pending.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// post sends one batch.
+func (c *Client) post(body []byte) error {
+	req, err := http.NewRequest("POST", c.URLs[c.url], bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if c.CompressionLevel != gzip.NoCompression {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	c.requests.Inc(1)
+	return c.sender.Send(req)
+}
@@ -0,0 +1,169 @@
+package logstashhttp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+// httpInput is a minimal logstash-input-http stand-in. It answers the queued
+// statuses in turn, then 200, and records the lines of the batches it accepts.
+type httpInput struct {
+	*httptest.Server
+	statuses []int
+
+	sync.Mutex
+	requests    int
+	lines       []string
+	lastRequest *http.Request
+}
+
+func newHTTPInput(statuses ...int) *httpInput {
+	s := &httpInput{statuses: statuses}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+func (s *httpInput) handle(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	s.requests++
+	s.lastRequest = r
+	if len(s.statuses) > 0 {
+		status := s.statuses[0]
+		s.statuses = s.statuses[1:]
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(status)
+		return
+	}
+
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body = zr
+	}
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		s.lines = append(s.lines, scanner.Text())
+	}
+	fmt.Fprint(w, "ok")
+}
+
+func (s *httpInput) Lines() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.lines...)
+}
+
+func event(message string) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+	e.Message = message
+	return e
+}
+
+func TestWrite(t *testing.T) {
+	s := newHTTPInput()
+	s.Start()
+	defer s.Close()
+	c, err := NewClient(Config{URLs: []string{s.URL}, BatchMaxEvents: 2, CompressionLevel: gzip.BestSpeed})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+
+	c.Write(event("one"))
+	assert.Empty(t, s.Lines(), "a batch is only sent once it is full")
+	c.Write(event("two"))
+	assert.Len(t, s.Lines(), 2)
+	c.Write(event("three"))
+	assert.Nil(t, c.Flush())
+
+	lines := s.Lines()
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[2], `"message":"three"`)
+	assert.Equal(t, 2, s.requests)
+	assert.Equal(t, "application/x-ndjson", s.lastRequest.Header.Get("Content-Type"))
+	assert.Equal(t, "gzip", s.lastRequest.Header.Get("Content-Encoding"))
+	assert.Nil(t, c.Health())
+}
+
+func TestFlush__retry(t *testing.T) {
+	s := newHTTPInput(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	s.Start()
+	defer s.Close()
+	c, err := NewClient(Config{URLs: []string{s.URL}, Retry: logstash.RetryPolicy{MaxElapsed: time.Duration(5 * time.Second)}})
+	assert.Nil(t, err)
+
+	c.Write(event("one"))
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 3, s.requests)
+	assert.Len(t, s.Lines(), 1)
+}
+
+func TestFlush__clientError(t *testing.T) {
+	s := newHTTPInput(http.StatusBadRequest)
+	s.Start()
+	defer s.Close()
+	c, err := NewClient(Config{URLs: []string{s.URL}})
+	assert.Nil(t, err)
+
+	c.Write(event("one"))
+	err = c.Flush()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "400")
+	assert.Equal(t, 1, s.requests, "4xx responses are not retried")
+	assert.Equal(t, 1, c.events, "the batch is kept until it is delivered")
+	assert.NotNil(t, c.Health())
+
+	// the next flush delivers the kept batch
+	assert.Nil(t, c.Flush())
+	assert.Len(t, s.Lines(), 1)
+	assert.Nil(t, c.Health())
+}
+
+func TestWrite__mutualTLS(t *testing.T) {
+	serverTLSConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	serverTLSConfig.ClientCAs = serverTLSConfig.RootCAs
+	serverTLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+
+	s := newHTTPInput()
+	s.TLS = serverTLSConfig
+	s.StartTLS()
+	defer s.Close()
+
+	clientTLSConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logger.key",
+		"../test/fixtures/certs/logger.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	c, err := NewClient(Config{URLs: []string{s.URL}, TLSConfig: clientTLSConfig})
+	assert.Nil(t, err)
+
+	c.Write(event("one"))
+	assert.Nil(t, c.Flush())
+	assert.Len(t, s.Lines(), 1)
+	assert.Equal(t, "logger", s.lastRequest.TLS.PeerCertificates[0].Subject.CommonName)
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient(Config{URLs: []string{"logstash:8080"}})
+	assert.NotNil(t, err)
+
+	_, err = NewClient(Config{URLs: []string{"https://logstash:8080"}, CompressionLevel: 10})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,302 @@
+// Package loki implements an output that pushes events to Grafana Loki.
+//
+// Events are grouped into streams by the values of an allowlist of journal fields,
+// which become the streams' labels alongside a set of static labels. Only allowlisted
+// fields become labels, to keep the number of streams bounded; each entry's line is
+// the whole event as JSON, so the other fields can still be queried with `| json`.
+package loki
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/httpoutput"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	pushPath = "/loki/api/v1/push"
+
+	defaultBatchMaxEvents = 1000
+	defaultBatchMaxBytes  = 1 << 20
+)
+
+var (
+	// DefaultLabelFields are the journal fields used as labels by default.
+	DefaultLabelFields = []string{"_SYSTEMD_UNIT", "_HOSTNAME", "PRIORITY"}
+	// DefaultStaticLabels are added to every stream if no static labels are set, since
+	// Loki rejects streams without labels.
+	DefaultStaticLabels = map[string]string{"job": "journal"}
+
+	labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// Loki reports the entries it refuses because they are too old for their stream
+	// with these phrases
+	outOfOrder = regexp.MustCompile(`out of order|too far behind|too old`)
+)
+
+// Config holds the settings for a Loki Client.
+type Config struct {
+	// URL is the base URL of Loki, such as https://loki:3100. The push API's path is
+	// added unless the URL has a path already.
+	URL string
+	// Format is "protobuf", for snappy compressed protobuf pushes, or "json".
+	Format    string
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// LabelFields are the journal fields whose values become labels. A field's label is
+	// its name in lower case without leading underscores, so _SYSTEMD_UNIT becomes
+	// systemd_unit.
+	LabelFields []string
+	// StaticLabels are added to every stream, or DefaultStaticLabels if empty.
+	StaticLabels map[string]string
+	// TenantID is sent as X-Scope-OrgID to a multi-tenant Loki.
+	TenantID string
+	// Username and Password authenticate with HTTP basic auth.
+	Username string
+	Password string
+	// BatchMaxEvents and BatchMaxBytes limit the size of a push, before encoding.
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	// RetryMaxElapsed is how long a push is retried before Flush gives up. A negative
+	// value retries for ever.
+	RetryMaxElapsed time.Duration
+}
+
+// ParseLabels returns the static labels given as name=value pairs.
+func ParseLabels(pairs []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid Loki label, expected name=value: %s", pair)
+		}
+		labels[pair[:i]] = pair[i+1:]
+	}
+	return labels, nil
+}
+
+// Client pushes Logstash V1Events to Loki.
+//
+// Write adds events to a batch, which is pushed once it is full. Flush pushes a
+// partially filled batch. Pushes answered with 429 or a 5xx, and network errors, are
+// retried. Entries Loki refuses as out of order are dropped, since retrying them can't
+// succeed, and counted by the loki_entries_rejected metric.
+type Client struct {
+	Config
+	sender  *httpoutput.Sender
+	labels  map[string]string // label name of each label field
+	streams map[string]*stream
+	order   []*stream
+	events  int
+	bytes   int
+	lastErr error
+	clientMetrics
+}
+
+type clientMetrics struct {
+	pushes      metrics.Counter
+	retries     metrics.Counter
+	rejected    metrics.Counter
+	pushStreams metrics.Histogram
+}
+
+// NewClient returns a Client object. Connections are made when the first batch is
+// pushed.
+func NewClient(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("loki URL must start with http:// or https://: %s", cfg.URL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = pushPath
+		cfg.URL = u.String()
+	}
+	if cfg.Format == "" {
+		cfg.Format = "protobuf"
+	}
+	if cfg.Format != "protobuf" && cfg.Format != "json" {
+		return nil, fmt.Errorf("unknown Loki push format: %s", cfg.Format)
+	}
+	if len(cfg.StaticLabels) == 0 {
+		cfg.StaticLabels = DefaultStaticLabels
+	}
+	for name := range cfg.StaticLabels {
+		if !labelName.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid Loki label name: %s", name)
+		}
+	}
+	labels := map[string]string{}
+	for _, field := range cfg.LabelFields {
+		name := strings.ToLower(strings.TrimLeft(field, "_"))
+		if !labelName.MatchString(name) {
+			return nil, fmt.Errorf("journal field %s cannot be a Loki label", field)
+		}
+		labels[field] = name
+	}
+	if cfg.BatchMaxEvents == 0 {
+		cfg.BatchMaxEvents = defaultBatchMaxEvents
+	}
+	if cfg.BatchMaxBytes == 0 {
+		cfg.BatchMaxBytes = defaultBatchMaxBytes
+	}
+
+	c := &Client{
+		Config: cfg,
+		sender: httpoutput.NewSender(httpoutput.Config{
+			Name:        "loki",
+			TLSConfig:   cfg.TLSConfig,
+			Timeout:     cfg.Timeout,
+			RetryPolicy: logstash.RetryPolicy{MaxElapsed: cfg.RetryMaxElapsed},
+		}),
+		labels:  labels,
+		streams: map[string]*stream{},
+		clientMetrics: clientMetrics{
+			pushes:      metrics.GetOrRegisterCounter("loki_pushes", metrics.DefaultRegistry),
+			retries:     metrics.GetOrRegisterCounter("loki_retries", metrics.DefaultRegistry),
+			rejected:    metrics.GetOrRegisterCounter("loki_entries_rejected", metrics.DefaultRegistry),
+			pushStreams: metrics.GetOrRegisterHistogram("loki_push_streams", metrics.DefaultRegistry, metrics.NewUniformSample(1028)),
+		},
+	}
+	return c, nil
+}
+
+// Open does nothing, since connections are made as batches are pushed.
+func (c *Client) Open() error {
+	return nil
+}
+
+// Write adds an event to the stream for its labels, and pushes the batch if it is
+// full. If pushing fails the event is removed from the batch again, so that the caller
+// may retry the Write.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	line, err := e.ToJSON()
+	if err != nil {
+		return 0, err
+	}
+
+	s := &stream{labels: map[string]string{}}
+	for name, v := range c.StaticLabels {
+		s.labels[name] = v
+	}
+	for field, name := range c.labels {
+		if v, ok := e.Fields[field]; ok {
+			s.labels[name] = v
+		}
+	}
+	key := s.key()
+	if existing, ok := c.streams[key]; ok {
+		s = existing
+	} else {
+		c.streams[key] = s
+		c.order = append(c.order, s)
+	}
+	s.entries = append(s.entries, entry{ts: e.Timestamp, line: string(line)})
+	c.events++
+	c.bytes += len(line)
+
+	if c.events >= c.BatchMaxEvents || c.bytes >= c.BatchMaxBytes {
+		if err := c.Flush(); err != nil {
+			s.entries = s.entries[:len(s.entries)-1]
+			if len(s.entries) == 0 {
+				delete(c.streams, key)
+				c.order = c.order[:len(c.order)-1]
+			}
+			c.events--
+			c.bytes -= len(line)
+			return 0, err
+		}
+	}
+	return len(line), nil
+}
+
+// Flush pushes the current batch and blocks until Loki has accepted it.
+func (c *Client) Flush() error {
+	if c.events == 0 {
+		return nil
+	}
+	streams := sortEntries(c.order)
+	var body []byte
+	var err error
+	if c.Format == "json" {
+		body, err = encodeJSON(streams)
+	} else {
+		body, err = encodeProto(streams)
+	}
+	if err != nil {
+		return err
+	}
+
+	err = c.sender.Retry(func() error {
+		err := c.push(body)
+		var status *httpoutput.StatusError
+		if errors.As(err, &status) && status.Status == http.StatusBadRequest && outOfOrder.MatchString(status.Body) {
+			// Loki stored the other entries
+			c.rejected.Inc(1)
+			log.Printf("Loki rejected entries that are out of order: %s", status.Body)
+			return nil
+		}
+		return err
+	}, func(error) {
+		c.retries.Inc(1)
+	})
+	c.lastErr = err
+	if err != nil {
+		return err
+	}
+	c.pushStreams.Update(int64(len(c.order)))
+	c.reset()
+	return nil
+}
+
+// Close discards any events that have not been pushed.
+func (c *Client) Close() error {
+	c.reset()
+	return nil
+}
+
+// Health returns the error of the last push that failed for good, if no push has
+// succeeded since.
+func (c *Client) Health() error {
+	return c.lastErr
+}
+
+func (c *Client) reset() {
+	c.streams = map[string]*stream{}
+	c.order = nil
+	c.events = 0
+	c.bytes = 0
+}
+
+// push sends one push request.
+func (c *Client) push(body []byte) error {
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.Format == "json" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	if c.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", c.TenantID)
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	c.pushes.Inc(1)
+	return c.sender.Send(req)
+}
@@ -0,0 +1,287 @@
+package loki
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// wireFields returns the fields of a protobuf message by number, with varints
+// formatted in decimal, whatever order they were encoded in.
+func wireFields(t *testing.T, b []byte) map[protowire.Number][]string {
+	fields := map[protowire.Number][]string{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		assert.True(t, n > 0)
+		b = b[n:]
+		var v string
+		switch typ {
+		case protowire.BytesType:
+			data, n := protowire.ConsumeBytes(b)
+			assert.True(t, n > 0)
+			v, b = string(data), b[n:]
+		case protowire.VarintType:
+			x, n := protowire.ConsumeVarint(b)
+			assert.True(t, n > 0)
+			v, b = strconv.FormatUint(x, 10), b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		fields[num] = append(fields[num], v)
+	}
+	return fields
+}
+
+func TestEncodeProto(t *testing.T) {
+	s := &stream{
+		labels:  map[string]string{"job": "j"},
+		entries: []entry{{ts: time.Unix(1, 2), line: "hi"}},
+	}
+	compressed, err := encodeProto([]*stream{s})
+	assert.Nil(t, err)
+	body, err := snappy.Decode(nil, compressed)
+	assert.Nil(t, err)
+
+	// PushRequest.streams
+	streams := wireFields(t, body)[1]
+	assert.Equal(t, 1, len(streams))
+	// StreamAdapter.labels and entries
+	stream := wireFields(t, []byte(streams[0]))
+	assert.Equal(t, []string{`{job="j"}`}, stream[1])
+	assert.Equal(t, 1, len(stream[2]))
+	// EntryAdapter.timestamp and line
+	entry := wireFields(t, []byte(stream[2][0]))
+	assert.Equal(t, []string{"hi"}, entry[2])
+	ts := wireFields(t, []byte(entry[1][0]))
+	assert.Equal(t, map[protowire.Number][]string{1: {"1"}, 2: {"2"}}, ts)
+}
+
+func TestNewClient(t *testing.T) {
+	c, err := NewClient(Config{URL: "http://loki:3100", LabelFields: DefaultLabelFields})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://loki:3100/loki/api/v1/push", c.URL)
+	assert.Equal(t, "protobuf", c.Format)
+	assert.Equal(t, "systemd_unit", c.labels["_SYSTEMD_UNIT"])
+
+	c, err = NewClient(Config{URL: "http://loki:3100/custom"})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://loki:3100/custom", c.URL)
+
+	_, err = NewClient(Config{URL: "loki:3100"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "http://loki", Format: "xml"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "http://loki", LabelFields: []string{"BAD-FIELD"}})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "http://loki", StaticLabels: map[string]string{"__name__": "x"}})
+	assert.NotNil(t, err)
+}
+
+func TestParseLabels(t *testing.T) {
+	labels, err := ParseLabels([]string{"job=journal", "env=a=b"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"job": "journal", "env": "a=b"}, labels)
+	_, err = ParseLabels([]string{"job"})
+	assert.NotNil(t, err)
+}
+
+// lokiStandIn records the JSON pushes it receives, answering the first of them with
+// the given status and body.
+type lokiStandIn struct {
+	sync.Mutex
+	status  int
+	body    string
+	pushes  []map[string]interface{}
+	headers []http.Header
+}
+
+func (l *lokiStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.Lock()
+	defer l.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	var push map[string]interface{}
+	json.Unmarshal(body, &push)
+	l.pushes = append(l.pushes, push)
+	l.headers = append(l.headers, r.Header)
+	if l.status != 0 {
+		status := l.status
+		l.status = 0
+		http.Error(w, l.body, status)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func journalEvent(unit string, ts time.Time) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(ts)
+	e.Message = "hello from " + unit
+	e.Fields["_SYSTEMD_UNIT"] = unit
+	e.Fields["_HOSTNAME"] = "web1"
+	e.Fields["MESSAGE_ID"] = "not a label"
+	return e
+}
+
+func TestWrite__json(t *testing.T) {
+	standIn := &lokiStandIn{}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{
+		URL:          server.URL,
+		Format:       "json",
+		LabelFields:  DefaultLabelFields,
+		StaticLabels: map[string]string{"job": "test"},
+		TenantID:     "tenant1",
+		Username:     "user",
+		Password:     "pass",
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+
+	now := time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC)
+	c.Write(journalEvent("nginx.service", now.Add(time.Second)))
+	c.Write(journalEvent("sshd.service", now))
+	c.Write(journalEvent("nginx.service", now))
+	assert.Nil(t, c.Flush())
+
+	assert.Equal(t, 1, len(standIn.pushes))
+	h := standIn.headers[0]
+	assert.Equal(t, "application/json", h.Get("Content-Type"))
+	assert.Equal(t, "tenant1", h.Get("X-Scope-OrgID"))
+	assert.True(t, strings.HasPrefix(h.Get("Authorization"), "Basic "))
+
+	streams := standIn.pushes[0]["streams"].([]interface{})
+	assert.Equal(t, 2, len(streams))
+	nginx := streams[0].(map[string]interface{})
+	assert.Equal(t, map[string]interface{}{"job": "test", "systemd_unit": "nginx.service", "hostname": "web1"}, nginx["stream"])
+	values := nginx["values"].([]interface{})
+	assert.Equal(t, 2, len(values))
+	// entries are sorted by time
+	assert.Equal(t, "1470830400000000000", values[0].([]interface{})[0])
+	assert.Equal(t, "1470830401000000000", values[1].([]interface{})[0])
+	assert.Contains(t, values[0].([]interface{})[1], `"MESSAGE_ID":"not a label"`)
+
+	// nothing left to push
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 1, len(standIn.pushes))
+}
+
+func TestWrite__protobuf(t *testing.T) {
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		compressed, _ := ioutil.ReadAll(r.Body)
+		body, _ = snappy.Decode(nil, compressed)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, LabelFields: []string{"_SYSTEMD_UNIT"}, BatchMaxEvents: 2})
+	assert.Nil(t, err)
+	now := time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC)
+	_, err = c.Write(journalEvent("nginx.service", now))
+	assert.Nil(t, err)
+	assert.Nil(t, body)
+	_, err = c.Write(journalEvent("nginx.service", now))
+	assert.Nil(t, err)
+
+	// the batch was full, so it was pushed by the second Write
+	assert.Contains(t, string(body), `{job="journal", systemd_unit="nginx.service"}`)
+	assert.Equal(t, 2, strings.Count(string(body), "hello from nginx.service"))
+}
+
+func TestFlush__outOfOrder(t *testing.T) {
+	standIn := &lokiStandIn{status: http.StatusBadRequest, body: "entry for stream '{job=\"journal\"}' has timestamp too old"}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, Format: "json"})
+	assert.Nil(t, err)
+	rejected := c.rejected.Count()
+	c.Write(journalEvent("nginx.service", time.Now()))
+
+	// the rejected entries are dropped rather than retried
+	assert.Nil(t, c.Flush())
+	assert.Nil(t, c.Health())
+	assert.Equal(t, 1, len(standIn.pushes))
+	assert.Equal(t, rejected+1, c.rejected.Count())
+}
+
+func TestFlush__retry(t *testing.T) {
+	standIn := &lokiStandIn{status: http.StatusTooManyRequests, body: "ingestion rate limit exceeded"}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, Format: "json"})
+	assert.Nil(t, err)
+	c.Write(journalEvent("nginx.service", time.Now()))
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 2, len(standIn.pushes))
+}
+
+func TestFlush__badRequest(t *testing.T) {
+	standIn := &lokiStandIn{status: http.StatusBadRequest, body: "error parsing labels"}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, Format: "json", BatchMaxEvents: 1})
+	assert.Nil(t, err)
+	_, err = c.Write(journalEvent("nginx.service", time.Now()))
+	assert.NotNil(t, err)
+	assert.NotNil(t, c.Health())
+	// the event was taken out of the batch, for the caller to retry
+	assert.Equal(t, 0, c.events)
+	assert.Equal(t, 0, len(c.order))
+	assert.Equal(t, 1, len(standIn.pushes))
+}
+
+func TestWrite__rollbackOutOfOrder(t *testing.T) {
+	standIn := &lokiStandIn{status: http.StatusBadRequest, body: "error parsing labels"}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, Format: "json", LabelFields: []string{"_SYSTEMD_UNIT"}, BatchMaxEvents: 3})
+	assert.Nil(t, err)
+	now := time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC)
+	late := journalEvent("nginx.service", now.Add(time.Second))
+	late.Message = "late"
+	c.Write(late)
+	c.Write(journalEvent("sshd.service", now))
+	early := journalEvent("nginx.service", now)
+	early.Message = "early"
+	_, err = c.Write(early)
+	assert.NotNil(t, err)
+
+	// the failed Write took out its own entry, although the push sorted it first
+	assert.Equal(t, 2, c.events)
+	assert.Equal(t, 2, len(c.order))
+	nginx := c.streams[`{job="journal", systemd_unit="nginx.service"}`]
+	assert.Equal(t, 1, len(nginx.entries))
+	assert.Contains(t, nginx.entries[0].line, `"message":"late"`)
+
+	// retrying the Write pushes each event once
+	_, err = c.Write(early)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(standIn.pushes))
+	var lines []string
+	for _, s := range standIn.pushes[1]["streams"].([]interface{}) {
+		for _, v := range s.(map[string]interface{})["values"].([]interface{}) {
+			lines = append(lines, v.([]interface{})[1].(string))
+		}
+	}
+	assert.Equal(t, 3, len(lines))
+	assert.Contains(t, lines[0], `"message":"early"`)
+	assert.Contains(t, lines[1], `"message":"late"`)
+}
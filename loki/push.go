@@ -0,0 +1,163 @@
+package loki
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// stream is the entries of a batch that share a set of labels.
+type stream struct {
+	labels  map[string]string
+	entries []entry
+}
+
+type entry struct {
+	ts   time.Time
+	line string
+}
+
+// key returns the stream's labels in the Prometheus text format Loki expects, such as
+// {hostname="web1", job="journal"}, with the names sorted.
+func (s *stream) key() string {
+	names := make([]string, 0, len(s.labels))
+	for name := range s.labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(s.labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// sortEntries returns copies of the streams with their entries ordered by time, since
+// Loki may reject entries older than the newest one it has for their stream. The
+// streams themselves are left in the order they were written, so that a failed Write
+// can take its entry out again.
+func sortEntries(streams []*stream) []*stream {
+	sorted := make([]*stream, len(streams))
+	for i, s := range streams {
+		entries := append([]entry(nil), s.entries...)
+		sort.SliceStable(entries, func(i, j int) bool {
+			return entries[i].ts.Before(entries[j].ts)
+		})
+		sorted[i] = &stream{labels: s.labels, entries: entries}
+	}
+	return sorted
+}
+
+// encodeJSON returns a push request in the JSON format of /loki/api/v1/push.
+func encodeJSON(streams []*stream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{}
+	for _, s := range streams {
+		js := jsonStream{Stream: s.labels}
+		for _, e := range s.entries {
+			js.Values = append(js.Values, [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line})
+		}
+		req.Streams = append(req.Streams, js)
+	}
+	return json.Marshal(req)
+}
+
+// pushFile describes Loki's logproto.PushRequest, from pkg/push/push.proto:
+//
+//	message PushRequest { repeated StreamAdapter streams = 1; }
+//	message StreamAdapter { string labels = 1; repeated EntryAdapter entries = 2; }
+//	message EntryAdapter { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+//
+// Loki's generated Go types live in its own module, along with the gogoproto runtime
+// they need, so pushes are built as dynamic messages of this descriptor instead.
+var pushFile = mustPushFile()
+
+func mustPushFile() protoreflect.FileDescriptor {
+	field := func(name string, number int32, label descriptorpb.FieldDescriptorProto_Label, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  label.Enum(),
+			Type:   typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	const (
+		optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		message  = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+		str      = descriptorpb.FieldDescriptorProto_TYPE_STRING
+	)
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:       proto.String("pkg/push/push.proto"),
+		Package:    proto.String("logproto"),
+		Dependency: []string{"google/protobuf/timestamp.proto"},
+		Syntax:     proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name:  proto.String("PushRequest"),
+			Field: []*descriptorpb.FieldDescriptorProto{field("streams", 1, repeated, message, ".logproto.StreamAdapter")},
+		}, {
+			Name: proto.String("StreamAdapter"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("labels", 1, optional, str, ""),
+				field("entries", 2, repeated, message, ".logproto.EntryAdapter"),
+			},
+		}, {
+			Name: proto.String("EntryAdapter"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("timestamp", 1, optional, message, ".google.protobuf.Timestamp"),
+				field("line", 2, optional, str, ""),
+			},
+		}},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
+// encodeProto returns a push request as a snappy compressed logproto.PushRequest.
+func encodeProto(streams []*stream) ([]byte, error) {
+	messages := pushFile.Messages()
+	streamFields := messages.ByName("StreamAdapter").Fields()
+	entryFields := messages.ByName("EntryAdapter").Fields()
+
+	req := dynamicpb.NewMessage(messages.ByName("PushRequest"))
+	list := req.Mutable(req.Descriptor().Fields().ByName("streams")).List()
+	for _, s := range streams {
+		msg := list.NewElement().Message()
+		msg.Set(streamFields.ByName("labels"), protoreflect.ValueOfString(s.key()))
+		entries := msg.Mutable(streamFields.ByName("entries")).List()
+		for _, e := range s.entries {
+			entry := entries.NewElement().Message()
+			entry.Set(entryFields.ByName("timestamp"), protoreflect.ValueOfMessage(timestamppb.New(e.ts).ProtoReflect()))
+			entry.Set(entryFields.ByName("line"), protoreflect.ValueOfString(e.line))
+			entries.Append(protoreflect.ValueOfMessage(entry))
+		}
+		list.Append(protoreflect.ValueOfMessage(msg))
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, b), nil
+}
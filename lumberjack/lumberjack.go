@@ -0,0 +1,273 @@
+// Package lumberjack implements a client for the Lumberjack (Beats) protocol version 2
+// as spoken by the logstash-input-beats plugin.
+//
+// Events are sent in windows. The server acknowledges each window and the client does
+// not consider the events delivered until that acknowledgement has been received.
+package lumberjack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	protocolVersion byte = '2'
+
+	frameWindowSize byte = 'W'
+	frameJSONData   byte = 'J'
+	frameCompressed byte = 'C'
+	frameAck        byte = 'A'
+)
+
+// Config holds the settings for a lumberjack Client.
+type Config struct {
+	URL string
+	// TLSConfig is used to connect to the server. If it is nil the client connects over plain TCP.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// WindowSize is the maximum number of events sent before waiting for an acknowledgement.
+	WindowSize int
+	// CompressionLevel is the zlib level used to compress each window. 0 disables compression.
+	CompressionLevel int
+	// Retry is how connection attempts are retried.
+	Retry logstash.RetryPolicy
+}
+
+// Client sends Logstash V1Events to a logstash-input-beats server.
+//
+// Write buffers events until the window is full and then sends the window and waits for
+// it to be acknowledged. Flush does the same for a partially filled window.
+type Client struct {
+	Config
+	conn    net.Conn
+	pending [][]byte
+	clientMetrics
+}
+
+type clientMetrics struct {
+	windowsAcked  metrics.Counter
+	windowsResent metrics.Counter
+}
+
+// NewClient returns a Client object. The connection to the server is established by Open,
+// or lazily when the first window is sent.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.WindowSize < 1 {
+		return nil, errors.New("window size must be at least 1")
+	}
+	if cfg.CompressionLevel < zlib.NoCompression || cfg.CompressionLevel > zlib.BestCompression {
+		return nil, fmt.Errorf("invalid compression level: %d", cfg.CompressionLevel)
+	}
+	c := &Client{
+		Config:  cfg,
+		pending: make([][]byte, 0, cfg.WindowSize),
+		clientMetrics: clientMetrics{
+			windowsAcked:  metrics.GetOrRegisterCounter("lumberjack_windows_acked", metrics.DefaultRegistry),
+			windowsResent: metrics.GetOrRegisterCounter("lumberjack_windows_resent", metrics.DefaultRegistry),
+		},
+	}
+	return c, nil
+}
+
+// Open connects to the server if a connection is not already established.
+func (c *Client) Open() error {
+	if c.conn != nil {
+		return nil
+	}
+	return c.connect()
+}
+
+// Write adds an event to the current window. If the window is full it is sent and
+// Write blocks until the server has acknowledged it. If sending fails the event is
+// removed from the window again, so that the caller may retry the Write.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	b, err := e.ToJSON()
+	if err != nil {
+		return 0, err
+	}
+	c.pending = append(c.pending, b)
+	if len(c.pending) >= c.WindowSize {
+		if err := c.sendAndRetry(); err != nil {
+			c.pending = c.pending[:len(c.pending)-1]
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends any events in a partially filled window and blocks until the server has
+// acknowledged them.
+func (c *Client) Flush() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	return c.sendAndRetry()
+}
+
+// Close closes an active connection to the server. Events that have not been
+// acknowledged are kept, and sent over a new connection by the next Flush or full
+// window.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Health returns an error if the client has no connection to the server.
+func (c *Client) Health() error {
+	if c.conn == nil {
+		return errors.New("not connected to lumberjack server")
+	}
+	return nil
+}
+
+// connect replaces the current connection, retrying as allowed by the retry policy.
+func (c *Client) connect() error {
+	return c.Retry.Do("lumberjack", c.connectOnce)
+}
+
+// connectOnce replaces the current connection, without retrying.
+func (c *Client) connectOnce() error {
+	c.Close()
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	if c.TLSConfig == nil {
+		conn, err = dialer.Dial("tcp", c.URL)
+	} else {
+		var host string
+		if host, _, err = net.SplitHostPort(c.URL); err != nil {
+			return err
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.URL, logstash.ConfigForHost(c.TLSConfig, host))
+	}
+	if err != nil {
+		log.Printf("Error connecting to lumberjack server: %s", err)
+		return err
+	}
+	log.Printf("Connected to lumberjack server: %s (%s)", c.URL, conn.RemoteAddr())
+	c.conn = conn
+	return nil
+}
+
+// sendAndRetry sends the pending window. If connecting, sending or waiting for the
+// acknowledgement fails the client reconnects and sends the whole window again, as
+// allowed by the retry policy, so the server may receive some events more than once
+// but never loses an event that was not acknowledged.
+func (c *Client) sendAndRetry() error {
+	sent := false
+	err := c.Retry.Do("lumberjack", func() error {
+		if c.conn == nil {
+			if err := c.connectOnce(); err != nil {
+				return err
+			}
+		}
+		if sent {
+			c.windowsResent.Inc(1)
+		}
+		sent = true
+		if err := c.send(); err != nil {
+			log.Printf("Error sending window to lumberjack server: %s", err)
+			c.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	c.pending = c.pending[:0]
+	return nil
+}
+
+// send writes the pending window to the connection and waits for the server to
+// acknowledge the last event in it.
+func (c *Client) send() error {
+	frames, err := c.encodeWindow()
+	if err != nil {
+		return err
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if _, err := c.conn.Write(frames); err != nil {
+		return err
+	}
+	if err := c.awaitAck(uint32(len(c.pending))); err != nil {
+		return err
+	}
+	c.windowsAcked.Inc(1)
+	return nil
+}
+
+// encodeWindow returns a window size frame followed by a JSON data frame for each
+// pending event, wrapped in a compressed frame if compression is enabled.
+func (c *Client) encodeWindow() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write([]byte{protocolVersion, frameWindowSize})
+	binary.Write(&buf, binary.BigEndian, uint32(len(c.pending)))
+
+	var data bytes.Buffer
+	for i, payload := range c.pending {
+		data.Write([]byte{protocolVersion, frameJSONData})
+		binary.Write(&data, binary.BigEndian, uint32(i+1))
+		binary.Write(&data, binary.BigEndian, uint32(len(payload)))
+		data.Write(payload)
+	}
+
+	if c.CompressionLevel == zlib.NoCompression {
+		buf.Write(data.Bytes())
+		return buf.Bytes(), nil
+	}
+
+	var compressed bytes.Buffer
+	w, err := zlib.NewWriterLevel(&compressed, c.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data.Bytes()); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	buf.Write([]byte{protocolVersion, frameCompressed})
+	binary.Write(&buf, binary.BigEndian, uint32(compressed.Len()))
+	buf.Write(compressed.Bytes())
+	return buf.Bytes(), nil
+}
+
+// awaitAck reads ACK frames until the server acknowledges seq. logstash-input-beats
+// sends partial ACKs while it works through a large window, each of which extends
+// the read deadline.
+func (c *Client) awaitAck(seq uint32) error {
+	frame := make([]byte, 6)
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(c.Timeout))
+		if _, err := io.ReadFull(c.conn, frame); err != nil {
+			return err
+		}
+		if frame[0] != protocolVersion || frame[1] != frameAck {
+			return fmt.Errorf("unexpected frame from server: %q", frame[:2])
+		}
+		acked := binary.BigEndian.Uint32(frame[2:])
+		if acked == seq {
+			return nil
+		}
+		if acked > seq {
+			return fmt.Errorf("server acknowledged sequence %d but only %d events were sent", acked, seq)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package lumberjack
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+// beatsServer is a minimal logstash-input-beats stand-in. It decodes windows of JSON
+// data frames and acknowledges each window once it has been read completely. The
+// first drops windows are read and the connection closed without an ACK.
+type beatsServer struct {
+	listener net.Listener
+	drops    int
+	events   []string
+	sync.Mutex
+}
+
+func newBeatsServer(t *testing.T, drops int) *beatsServer {
+	serverTLSConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	assert.Nil(t, err)
+
+	s := &beatsServer{listener: listener, drops: drops}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *beatsServer) serve(conn net.Conn) {
+	defer conn.Close()
+	var window, received uint32
+	var r io.Reader = conn
+	for {
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(r, header); err != nil {
+			if r != io.Reader(conn) {
+				// finished reading a compressed frame
+				r = conn
+				continue
+			}
+			return
+		}
+		switch header[1] {
+		case frameWindowSize:
+			binary.Read(r, binary.BigEndian, &window)
+			received = 0
+		case frameCompressed:
+			var length uint32
+			binary.Read(r, binary.BigEndian, &length)
+			payload := make([]byte, length)
+			io.ReadFull(r, payload)
+			zr, err := zlib.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				return
+			}
+			decompressed, _ := ioutil.ReadAll(zr)
+			r = bytes.NewReader(decompressed)
+			continue
+		case frameJSONData:
+			var seq, length uint32
+			binary.Read(r, binary.BigEndian, &seq)
+			binary.Read(r, binary.BigEndian, &length)
+			payload := make([]byte, length)
+			io.ReadFull(r, payload)
+			received = seq
+			s.Lock()
+			if s.drops > 0 {
+				if received == window {
+					s.drops--
+					s.Unlock()
+					return
+				}
+			} else {
+				s.events = append(s.events, string(payload))
+			}
+			s.Unlock()
+		}
+		if window > 0 && received == window {
+			ack := []byte{protocolVersion, frameAck, 0, 0, 0, 0}
+			binary.BigEndian.PutUint32(ack[2:], received)
+			conn.Write(ack)
+			window = 0
+		}
+	}
+}
+
+func (s *beatsServer) Events() []string {
+	s.Lock()
+	defer s.Unlock()
+	return append([]string{}, s.events...)
+}
+
+func newTestClient(t *testing.T, s *beatsServer, windowSize, compressionLevel int) *Client {
+	return newTestClientWithRetry(t, s, windowSize, compressionLevel, logstash.RetryPolicy{})
+}
+
+func newTestClientWithRetry(t *testing.T, s *beatsServer, windowSize, compressionLevel int, retry logstash.RetryPolicy) *Client {
+	tlsConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logger.key",
+		"../test/fixtures/certs/logger.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	c, err := NewClient(Config{
+		URL:              s.listener.Addr().String(),
+		TLSConfig:        tlsConfig,
+		Timeout:          5 * time.Second,
+		WindowSize:       windowSize,
+		CompressionLevel: compressionLevel,
+		Retry:            retry,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+	return c
+}
+
+func testEvent(msg string) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.Message = msg
+	e.SetTimestamp(time.Unix(1515151515, 0))
+	return e
+}
+
+func TestNewClient__invalidConfig(t *testing.T) {
+	_, err := NewClient(Config{WindowSize: 0})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{WindowSize: 10, CompressionLevel: 12})
+	assert.NotNil(t, err)
+}
+
+func TestWriteAndFlush(t *testing.T) {
+	for _, level := range []int{0, 3} {
+		s := newBeatsServer(t, 0)
+		c := newTestClient(t, s, 2, level)
+
+		// a full window is sent and acknowledged by Write
+		c.Write(testEvent("one"))
+		_, err := c.Write(testEvent("two"))
+		assert.Nil(t, err)
+		assert.Equal(t, 2, len(s.Events()))
+		assert.Equal(t, 0, len(c.pending))
+
+		// a partial window is held until Flush
+		c.Write(testEvent("three"))
+		assert.Equal(t, 2, len(s.Events()))
+		assert.Nil(t, c.Flush())
+		events := s.Events()
+		assert.Equal(t, 3, len(events))
+		assert.Contains(t, events[2], `"message":"three"`)
+
+		c.Close()
+		s.listener.Close()
+	}
+}
+
+func TestFlush__resendsUnacknowledgedWindow(t *testing.T) {
+	s := newBeatsServer(t, 1)
+	defer s.listener.Close()
+	c := newTestClient(t, s, 10, 3)
+	defer c.Close()
+
+	c.Write(testEvent("one"))
+	c.Write(testEvent("two"))
+	assert.Nil(t, c.Flush())
+
+	// the first attempt was dropped by the server, the retry must carry the whole window
+	events := s.Events()
+	assert.Equal(t, 2, len(events))
+	assert.Contains(t, events[0], `"message":"one"`)
+	assert.Contains(t, events[1], `"message":"two"`)
+}
+
+func TestFlush__retryPolicy(t *testing.T) {
+	s := newBeatsServer(t, 2)
+	defer s.listener.Close()
+	c := newTestClientWithRetry(t, s, 10, 0, logstash.RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond})
+	defer c.Close()
+	resent := c.windowsResent.Count()
+
+	// each failed window is resent over a new connection until the policy gives up
+	c.Write(testEvent("one"))
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 1, len(s.Events()))
+	assert.Equal(t, resent+2, c.windowsResent.Count())
+
+	s.Lock()
+	s.drops = 2
+	s.Unlock()
+	c.Write(testEvent("two"))
+	c.Retry.MaxAttempts = 2
+	err := c.Flush()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "giving up after 2 attempts")
+	assert.Equal(t, 1, len(c.pending))
+}
+
+func TestClose__keepsUnacknowledgedWindow(t *testing.T) {
+	s := newBeatsServer(t, 0)
+	defer s.listener.Close()
+	c := newTestClient(t, s, 10, 0)
+	defer c.Close()
+
+	c.Write(testEvent("one"))
+	assert.Nil(t, c.Close())
+	assert.Nil(t, c.Flush())
+	events := s.Events()
+	assert.Equal(t, 1, len(events))
+	assert.Contains(t, events[0], `"message":"one"`)
+}
+
+func TestOpen__retryPolicy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	c, err := NewClient(Config{
+		URL:        addr,
+		Timeout:    time.Second,
+		WindowSize: 1,
+		Retry:      logstash.RetryPolicy{MaxAttempts: 2, InitialInterval: time.Millisecond},
+	})
+	assert.Nil(t, err)
+	err = c.Open()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "giving up after 2 attempts")
+}
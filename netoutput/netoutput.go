@@ -0,0 +1,141 @@
+// Package netoutput holds what the outputs that write each event straight to a
+// connection have in common: dialing, over TLS if configured, as the shared retry
+// policy allows, and writing with a deadline, reconnecting and writing again as the
+// policy allows if a write fails.
+// Each output is left with the encoding and framing of its messages.
+package netoutput
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+)
+
+// Config holds the settings for a Conn.
+type Config struct {
+	// Name names the kind of server in logs and the <Name>_retries.<cause> metrics,
+	// such as "gelf".
+	Name string
+	// Network is "tcp", the default, or "udp".
+	Network string
+	// URL is the host:port of the server.
+	URL string
+	// TLSConfig is used to connect over TCP. If it is nil the connection is plain TCP.
+	// It is ignored for UDP.
+	TLSConfig *tls.Config
+	// Timeout limits connecting and each write. 0 disables it.
+	Timeout time.Duration
+	// RetryPolicy is how connection attempts are spaced and when they give up.
+	RetryPolicy logstash.RetryPolicy
+}
+
+// Conn is a connection to a server that is established on demand and re-established
+// after a failed write.
+type Conn struct {
+	Config
+	conn net.Conn
+}
+
+// New returns a Conn. It doesn't connect until Open or the first Write.
+func New(cfg Config) *Conn {
+	if cfg.Network == "" {
+		cfg.Network = "tcp"
+	}
+	cfg.RetryPolicy = cfg.RetryPolicy.WithDefaults()
+	return &Conn{Config: cfg}
+}
+
+// Open connects to the server if a connection is not already established.
+func (c *Conn) Open() error {
+	if c.conn != nil {
+		return nil
+	}
+	return c.connect()
+}
+
+// Write writes b. If connecting or writing fails it reconnects and writes b again, as
+// allowed by the retry policy.
+func (c *Conn) Write(b []byte) error {
+	return c.RetryPolicy.Do(c.Name, func() error {
+		if c.conn == nil {
+			if err := c.connectOnce(); err != nil {
+				return err
+			}
+		}
+		if err := c.write(b); err != nil {
+			log.Printf("Error writing to %s server: %s", c.Name, err)
+			c.Close()
+			return err
+		}
+		return nil
+	})
+}
+
+// WriteOnce writes b to the current connection, connecting first if there is none,
+// and leaves it to the caller to handle a failed write.
+func (c *Conn) WriteOnce(b []byte) error {
+	if err := c.Open(); err != nil {
+		return err
+	}
+	return c.write(b)
+}
+
+// write writes b to the current connection with the write deadline.
+func (c *Conn) write(b []byte) error {
+	if c.Timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+// Close closes an active connection to the server.
+func (c *Conn) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+// Health returns an error if there is no connection to the server.
+func (c *Conn) Health() error {
+	if c.conn == nil {
+		return fmt.Errorf("not connected to %s server", c.Name)
+	}
+	return nil
+}
+
+// connect replaces the current connection, retrying as allowed by the retry policy.
+func (c *Conn) connect() error {
+	return c.RetryPolicy.Do(c.Name, c.connectOnce)
+}
+
+// connectOnce replaces the current connection, without retrying.
+func (c *Conn) connectOnce() error {
+	c.Close()
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	if c.Network == "tcp" && c.TLSConfig != nil {
+		var host string
+		if host, _, err = net.SplitHostPort(c.URL); err != nil {
+			return err
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.URL, logstash.ConfigForHost(c.TLSConfig, host))
+	} else {
+		conn, err = dialer.Dial(c.Network, c.URL)
+	}
+	if err != nil {
+		log.Printf("Error connecting to %s server: %s", c.Name, err)
+		return err
+	}
+	log.Printf("Connected to %s server: %s (%s)", c.Name, c.URL, conn.RemoteAddr())
+	c.conn = conn
+	return nil
+}
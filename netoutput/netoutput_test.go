@@ -0,0 +1,117 @@
+package netoutput
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite__reconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+	lines := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			lines <- line
+			conn.Close()
+		}
+	}()
+
+	c := New(Config{Name: "test", URL: l.Addr().String(), Timeout: time.Second,
+		RetryPolicy: logstash.RetryPolicy{InitialInterval: time.Millisecond}})
+	defer c.Close()
+	assert.NotNil(t, c.Health())
+	assert.Nil(t, c.Open())
+	assert.Nil(t, c.Health())
+	assert.Nil(t, c.Write([]byte("one\n")))
+	assert.Equal(t, "one\n", <-lines)
+
+	// the server has closed the first connection, so writing to it fails sooner or
+	// later and the line is written again over a new one
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, c.Write([]byte("two\n")))
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case line := <-lines:
+		assert.Equal(t, "two\n", line)
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for line")
+	}
+}
+
+func TestWrite__retryPolicy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := l.Addr().String()
+	l.Close()
+
+	// the connection attempts made by Write itself are covered by the policy too
+	c := New(Config{
+		Name:        "test",
+		URL:         addr,
+		Timeout:     time.Second,
+		RetryPolicy: logstash.RetryPolicy{MaxAttempts: 2, InitialInterval: time.Millisecond},
+	})
+	err = c.Write([]byte("one\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "giving up after 2 attempts")
+	assert.NotNil(t, c.Health())
+}
+
+func TestOpen__retryPolicy(t *testing.T) {
+	serverTLSConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	assert.Nil(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	// a client that trusts no CA fails every handshake
+	retries := metrics.GetOrRegisterCounter("test_retries.tls_verify", metrics.DefaultRegistry)
+	before := retries.Count()
+	c := New(Config{
+		Name:        "test",
+		URL:         l.Addr().String(),
+		TLSConfig:   &tls.Config{RootCAs: x509.NewCertPool()},
+		Timeout:     time.Second,
+		RetryPolicy: logstash.RetryPolicy{MaxAttempts: 3, InitialInterval: time.Millisecond},
+	})
+	start := time.Now()
+	err = c.Open()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "giving up after 3 attempts")
+	assert.True(t, time.Since(start) < 5*time.Second)
+	assert.Equal(t, int64(2), retries.Count()-before)
+	assert.NotNil(t, c.Health())
+
+	// a malformed address isn't retried
+	c = New(Config{Name: "test", URL: "no port"})
+	err = c.Open()
+	assert.NotNil(t, err)
+	assert.NotContains(t, err.Error(), "giving up")
+}
@@ -0,0 +1,374 @@
+package otlp
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// scopeName is the InstrumentationScope of every LogRecord.
+const scopeName = "journal-2-logstash"
+
+// resourceFields are the journal fields mapped to resource attributes rather than
+// LogRecord attributes. _BOOT_ID has no semantic convention, so it keeps a journald
+// prefix.
+var resourceFields = []struct {
+	field, attribute string
+}{
+	{"_HOSTNAME", "host.name"},
+	{"_MACHINE_ID", "host.id"},
+	{"_BOOT_ID", "journald.boot_id"},
+}
+
+// severities maps PRIORITY to a SeverityNumber and text, following the journald
+// receiver of the OpenTelemetry collector.
+var severities = [8]struct {
+	number int
+	text   string
+}{
+	{21, "emerg"},   // FATAL
+	{19, "alert"},   // ERROR3
+	{18, "crit"},    // ERROR2
+	{17, "err"},     // ERROR
+	{13, "warning"}, // WARN
+	{10, "notice"},  // INFO2
+	{9, "info"},     // INFO
+	{5, "debug"},    // DEBUG
+}
+
+type keyValue struct {
+	key, value string
+}
+
+// resourceLogs is the LogRecords of a batch that share a resource.
+type resourceLogs struct {
+	attributes []keyValue
+	records    []logRecord
+}
+
+type logRecord struct {
+	time         time.Time
+	observed     time.Time
+	severity     int
+	severityText string
+	body         string
+	attributes   []keyValue
+}
+
+// newResourceLogs groups events into resourceLogs by their resource fields, keeping
+// the order in which each resource first appears.
+func newResourceLogs(events []*logstash.V1Event, observed time.Time) []*resourceLogs {
+	var all []*resourceLogs
+	byKey := map[string]*resourceLogs{}
+	for _, e := range events {
+		var key string
+		var resource []keyValue
+		for _, f := range resourceFields {
+			v, ok := e.Fields[f.field]
+			key += v + "\x00"
+			if ok {
+				resource = append(resource, keyValue{f.attribute, v})
+			}
+		}
+		rl, ok := byKey[key]
+		if !ok {
+			rl = &resourceLogs{attributes: resource}
+			byKey[key] = rl
+			all = append(all, rl)
+		}
+		rl.records = append(rl.records, newLogRecord(e, observed))
+	}
+	return all
+}
+
+// newLogRecord maps an event to a LogRecord: PRIORITY sets the severity, MESSAGE is
+// the body, and every field other than the resource fields becomes an attribute.
+func newLogRecord(e *logstash.V1Event, observed time.Time) logRecord {
+	r := logRecord{time: e.Timestamp, observed: observed, body: e.Message}
+	if p, err := strconv.Atoi(e.Fields["PRIORITY"]); err == nil && p >= 0 && p < len(severities) {
+		r.severity = severities[p].number
+		r.severityText = severities[p].text
+	}
+	names := make([]string, 0, len(e.Fields))
+	for name := range e.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+NAMES:
+	for _, name := range names {
+		for _, f := range resourceFields {
+			if name == f.field {
+				continue NAMES
+			}
+		}
+		r.attributes = append(r.attributes, keyValue{name, e.Fields[name]})
+	}
+	return r
+}
+
+// encodeJSON returns an ExportLogsServiceRequest in the OTLP/JSON encoding, which
+// uses lowerCamelCase field names and strings for 64 bit integers.
+func encodeJSON(all []*resourceLogs) ([]byte, error) {
+	type anyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+	type kv struct {
+		Key   string   `json:"key"`
+		Value anyValue `json:"value"`
+	}
+	type record struct {
+		TimeUnixNano         string   `json:"timeUnixNano"`
+		ObservedTimeUnixNano string   `json:"observedTimeUnixNano"`
+		SeverityNumber       int      `json:"severityNumber,omitempty"`
+		SeverityText         string   `json:"severityText,omitempty"`
+		Body                 anyValue `json:"body"`
+		Attributes           []kv     `json:"attributes,omitempty"`
+	}
+	type scopeLogs struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		LogRecords []record `json:"logRecords"`
+	}
+	type resourceLogs struct {
+		Resource struct {
+			Attributes []kv `json:"attributes,omitempty"`
+		} `json:"resource"`
+		ScopeLogs []scopeLogs `json:"scopeLogs"`
+	}
+	kvs := func(in []keyValue) []kv {
+		var out []kv
+		for _, a := range in {
+			out = append(out, kv{a.key, anyValue{a.value}})
+		}
+		return out
+	}
+
+	req := struct {
+		ResourceLogs []resourceLogs `json:"resourceLogs"`
+	}{}
+	for _, rl := range all {
+		var jrl resourceLogs
+		jrl.Resource.Attributes = kvs(rl.attributes)
+		var sl scopeLogs
+		sl.Scope.Name = scopeName
+		for _, r := range rl.records {
+			sl.LogRecords = append(sl.LogRecords, record{
+				TimeUnixNano:         strconv.FormatInt(r.time.UnixNano(), 10),
+				ObservedTimeUnixNano: strconv.FormatInt(r.observed.UnixNano(), 10),
+				SeverityNumber:       r.severity,
+				SeverityText:         r.severityText,
+				Body:                 anyValue{r.body},
+				Attributes:           kvs(r.attributes),
+			})
+		}
+		jrl.ScopeLogs = []scopeLogs{sl}
+		req.ResourceLogs = append(req.ResourceLogs, jrl)
+	}
+	return json.Marshal(req)
+}
+
+// partialSuccess is the ExportLogsPartialSuccess of a response, reporting records the
+// receiver rejected.
+type partialSuccess struct {
+	RejectedLogRecords int64
+	ErrorMessage       string
+}
+
+// decodeResponseJSON returns the partial success of an ExportLogsServiceResponse in
+// the OTLP/JSON encoding.
+func decodeResponseJSON(b []byte) (partialSuccess, error) {
+	var resp struct {
+		PartialSuccess struct {
+			// 64 bit integers are strings in OTLP/JSON, but receivers accept numbers
+			RejectedLogRecords json.Number `json:"rejectedLogRecords"`
+			ErrorMessage       string      `json:"errorMessage"`
+		} `json:"partialSuccess"`
+	}
+	if len(b) == 0 {
+		return partialSuccess{}, nil
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return partialSuccess{}, err
+	}
+	ps := partialSuccess{ErrorMessage: resp.PartialSuccess.ErrorMessage}
+	if resp.PartialSuccess.RejectedLogRecords != "" {
+		n, err := resp.PartialSuccess.RejectedLogRecords.Int64()
+		if err != nil {
+			return partialSuccess{}, err
+		}
+		ps.RejectedLogRecords = n
+	}
+	return ps, nil
+}
+
+// logsFile describes the messages of an OTLP/HTTP logs export, from
+// opentelemetry/proto/collector/logs/v1/logs_service.proto and the files it imports,
+// trimmed to the fields this package uses:
+//
+//	message ExportLogsServiceRequest { repeated ResourceLogs resource_logs = 1; }
+//	message ResourceLogs { Resource resource = 1; repeated ScopeLogs scope_logs = 2; }
+//	message Resource { repeated KeyValue attributes = 1; }
+//	message ScopeLogs { InstrumentationScope scope = 1; repeated LogRecord log_records = 2; }
+//	message InstrumentationScope { string name = 1; }
+//	message LogRecord {
+//	  fixed64 time_unix_nano = 1; fixed64 observed_time_unix_nano = 11;
+//	  SeverityNumber severity_number = 2; string severity_text = 3;
+//	  AnyValue body = 5; repeated KeyValue attributes = 6;
+//	}
+//	message KeyValue { string key = 1; AnyValue value = 2; }
+//	message AnyValue { string string_value = 1; }
+//	message ExportLogsServiceResponse { ExportLogsPartialSuccess partial_success = 1; }
+//	message ExportLogsPartialSuccess { int64 rejected_log_records = 1; string error_message = 2; }
+//
+// The SeverityNumber enum is declared as int32, which has the same wire encoding. The
+// generated Go types live in the OpenTelemetry proto module, so requests are built as
+// dynamic messages of this descriptor instead.
+var logsFile = mustLogsFile()
+
+func mustLogsFile() protoreflect.FileDescriptor {
+	field := func(name string, number int32, label descriptorpb.FieldDescriptorProto_Label, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Label:  label.Enum(),
+			Type:   typ.Enum(),
+		}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	msg := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	const (
+		optional = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL
+		repeated = descriptorpb.FieldDescriptorProto_LABEL_REPEATED
+		message  = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+		str      = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		fixed64  = descriptorpb.FieldDescriptorProto_TYPE_FIXED64
+		int32_   = descriptorpb.FieldDescriptorProto_TYPE_INT32
+		int64_   = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		pkg      = ".opentelemetry.proto.logs.v1."
+	)
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:    proto.String("journal-2-logstash/otlp/logs.proto"),
+		Package: proto.String("opentelemetry.proto.logs.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			msg("ExportLogsServiceRequest", field("resource_logs", 1, repeated, message, pkg+"ResourceLogs")),
+			msg("ResourceLogs",
+				field("resource", 1, optional, message, pkg+"Resource"),
+				field("scope_logs", 2, repeated, message, pkg+"ScopeLogs"),
+			),
+			msg("Resource", field("attributes", 1, repeated, message, pkg+"KeyValue")),
+			msg("ScopeLogs",
+				field("scope", 1, optional, message, pkg+"InstrumentationScope"),
+				field("log_records", 2, repeated, message, pkg+"LogRecord"),
+			),
+			msg("InstrumentationScope", field("name", 1, optional, str, "")),
+			msg("LogRecord",
+				field("time_unix_nano", 1, optional, fixed64, ""),
+				field("severity_number", 2, optional, int32_, ""),
+				field("severity_text", 3, optional, str, ""),
+				field("body", 5, optional, message, pkg+"AnyValue"),
+				field("attributes", 6, repeated, message, pkg+"KeyValue"),
+				field("observed_time_unix_nano", 11, optional, fixed64, ""),
+			),
+			msg("KeyValue",
+				field("key", 1, optional, str, ""),
+				field("value", 2, optional, message, pkg+"AnyValue"),
+			),
+			msg("AnyValue", field("string_value", 1, optional, str, "")),
+			msg("ExportLogsServiceResponse", field("partial_success", 1, optional, message, pkg+"ExportLogsPartialSuccess")),
+			msg("ExportLogsPartialSuccess",
+				field("rejected_log_records", 1, optional, int64_, ""),
+				field("error_message", 2, optional, str, ""),
+			),
+		},
+	}, protoregistry.GlobalFiles)
+	if err != nil {
+		panic(err)
+	}
+	return file
+}
+
+// encodeProto returns an ExportLogsServiceRequest in the binary protobuf encoding.
+func encodeProto(all []*resourceLogs) ([]byte, error) {
+	messages := logsFile.Messages()
+	fieldsOf := func(name string) protoreflect.FieldDescriptors {
+		return messages.ByName(protoreflect.Name(name)).Fields()
+	}
+	rlFields := fieldsOf("ResourceLogs")
+	slFields := fieldsOf("ScopeLogs")
+	recordFields := fieldsOf("LogRecord")
+	kvFields := fieldsOf("KeyValue")
+	stringValue := fieldsOf("AnyValue").ByName("string_value")
+
+	anyValue := func(parent protoreflect.Message, fd protoreflect.FieldDescriptor, s string) {
+		parent.Mutable(fd).Message().Set(stringValue, protoreflect.ValueOfString(s))
+	}
+	setKVs := func(list protoreflect.List, in []keyValue) {
+		for _, a := range in {
+			kv := list.NewElement().Message()
+			kv.Set(kvFields.ByName("key"), protoreflect.ValueOfString(a.key))
+			anyValue(kv, kvFields.ByName("value"), a.value)
+			list.Append(protoreflect.ValueOfMessage(kv))
+		}
+	}
+
+	req := dynamicpb.NewMessage(messages.ByName("ExportLogsServiceRequest"))
+	list := req.Mutable(req.Descriptor().Fields().ByName("resource_logs")).List()
+	for _, rl := range all {
+		prl := list.NewElement().Message()
+		resource := prl.Mutable(rlFields.ByName("resource")).Message()
+		setKVs(resource.Mutable(fieldsOf("Resource").ByName("attributes")).List(), rl.attributes)
+
+		scopeLogs := prl.Mutable(rlFields.ByName("scope_logs")).List()
+		sl := scopeLogs.NewElement().Message()
+		scope := sl.Mutable(slFields.ByName("scope")).Message()
+		scope.Set(fieldsOf("InstrumentationScope").ByName("name"), protoreflect.ValueOfString(scopeName))
+		records := sl.Mutable(slFields.ByName("log_records")).List()
+		for _, r := range rl.records {
+			pr := records.NewElement().Message()
+			pr.Set(recordFields.ByName("time_unix_nano"), protoreflect.ValueOfUint64(uint64(r.time.UnixNano())))
+			pr.Set(recordFields.ByName("observed_time_unix_nano"), protoreflect.ValueOfUint64(uint64(r.observed.UnixNano())))
+			if r.severity != 0 {
+				pr.Set(recordFields.ByName("severity_number"), protoreflect.ValueOfInt32(int32(r.severity)))
+				pr.Set(recordFields.ByName("severity_text"), protoreflect.ValueOfString(r.severityText))
+			}
+			anyValue(pr, recordFields.ByName("body"), r.body)
+			setKVs(pr.Mutable(recordFields.ByName("attributes")).List(), r.attributes)
+			records.Append(protoreflect.ValueOfMessage(pr))
+		}
+		scopeLogs.Append(protoreflect.ValueOfMessage(sl))
+		list.Append(protoreflect.ValueOfMessage(prl))
+	}
+	return proto.Marshal(req)
+}
+
+// decodeResponseProto returns the partial success of an ExportLogsServiceResponse in
+// the binary protobuf encoding.
+func decodeResponseProto(b []byte) (partialSuccess, error) {
+	messages := logsFile.Messages()
+	resp := dynamicpb.NewMessage(messages.ByName("ExportLogsServiceResponse"))
+	if err := proto.Unmarshal(b, resp); err != nil {
+		return partialSuccess{}, err
+	}
+	ps := resp.Get(resp.Descriptor().Fields().ByName("partial_success")).Message()
+	psFields := messages.ByName("ExportLogsPartialSuccess").Fields()
+	return partialSuccess{
+		RejectedLogRecords: ps.Get(psFields.ByName("rejected_log_records")).Int(),
+		ErrorMessage:       ps.Get(psFields.ByName("error_message")).String(),
+	}, nil
+}
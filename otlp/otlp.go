@@ -0,0 +1,293 @@
+// Package otlp implements an output that exports events as OpenTelemetry LogRecords
+// over OTLP/HTTP, to an OpenTelemetry collector or any other OTLP receiver. Requests
+// use the binary protobuf encoding by default, or the OTLP/JSON encoding.
+//
+// Each event becomes a LogRecord whose severity comes from PRIORITY, whose body is
+// MESSAGE, and whose attributes are the event's other fields. _HOSTNAME, _MACHINE_ID
+// and _BOOT_ID become the host.name, host.id and journald.boot_id resource attributes,
+// and records are grouped into ResourceLogs by them.
+package otlp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/httpoutput"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	logsPath = "/v1/logs"
+
+	defaultBatchMaxEvents = 512
+	defaultBatchMaxBytes  = 1 << 20
+)
+
+// Config holds the settings for an OTLP Client.
+type Config struct {
+	// URL is the base URL of the receiver, such as https://otel-collector:4318. The
+	// logs path is added unless the URL has a path already.
+	URL string
+	// TLSConfig is used for https URLs, or Go's defaults if nil.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// Headers are added to every request, for example to authenticate.
+	Headers map[string]string
+	// Format is "protobuf", the default, or "json".
+	Format string
+	// Compression is "gzip" or "none".
+	Compression string
+	// BatchMaxEvents and BatchMaxBytes limit the size of a batch. The size of an event
+	// is estimated from its message and fields.
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	// RetryMaxElapsed is how long a batch is retried before Flush gives up. A negative
+	// value retries for ever.
+	RetryMaxElapsed time.Duration
+}
+
+// ParseHeaders returns the headers given as name=value pairs.
+func ParseHeaders(pairs []string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range pairs {
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid OTLP header, expected name=value: %s", pair)
+		}
+		headers[pair[:i]] = pair[i+1:]
+	}
+	return headers, nil
+}
+
+// Client exports Logstash V1Events to an OTLP/HTTP receiver.
+//
+// Write adds events to a batch, which is exported once it is full. Flush exports a
+// partially filled batch. As the OTLP specification requires, responses 429, 502,
+// 503 and 504, and network errors, are retried, waiting at least as long as the
+// Retry-After header asks, while other responses fail the batch. Records the receiver
+// rejects in a partial success are dropped and counted by otlp_records_rejected.
+type Client struct {
+	Config
+	sender  *httpoutput.Sender
+	pending []*logstash.V1Event
+	bytes   int
+	lastErr error
+	clientMetrics
+}
+
+type clientMetrics struct {
+	requests  metrics.Counter
+	retries   metrics.Counter
+	rejected  metrics.Counter
+	batchSize metrics.Histogram
+}
+
+// temporary returns true for the responses the OTLP specification marks retryable.
+func temporary(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// NewClient returns a Client object. Connections are made when the first batch is
+// exported.
+func NewClient(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("OTLP URL must start with http:// or https://: %s", cfg.URL)
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = logsPath
+		cfg.URL = u.String()
+	}
+	if cfg.Format == "" {
+		cfg.Format = "protobuf"
+	}
+	if cfg.Format != "protobuf" && cfg.Format != "json" {
+		return nil, fmt.Errorf("unknown OTLP format: %s", cfg.Format)
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = "gzip"
+	}
+	if cfg.Compression != "gzip" && cfg.Compression != "none" {
+		return nil, fmt.Errorf("unknown OTLP compression: %s", cfg.Compression)
+	}
+	if cfg.BatchMaxEvents == 0 {
+		cfg.BatchMaxEvents = defaultBatchMaxEvents
+	}
+	if cfg.BatchMaxBytes == 0 {
+		cfg.BatchMaxBytes = defaultBatchMaxBytes
+	}
+
+	c := &Client{
+		Config: cfg,
+		sender: httpoutput.NewSender(httpoutput.Config{
+			Name:        "otlp receiver",
+			TLSConfig:   cfg.TLSConfig,
+			Timeout:     cfg.Timeout,
+			RetryPolicy: logstash.RetryPolicy{MaxElapsed: cfg.RetryMaxElapsed},
+			Temporary:   temporary,
+		}),
+		clientMetrics: clientMetrics{
+			requests:  metrics.GetOrRegisterCounter("otlp_requests", metrics.DefaultRegistry),
+			retries:   metrics.GetOrRegisterCounter("otlp_retries", metrics.DefaultRegistry),
+			rejected:  metrics.GetOrRegisterCounter("otlp_records_rejected", metrics.DefaultRegistry),
+			batchSize: metrics.GetOrRegisterHistogram("otlp_batch_size", metrics.DefaultRegistry, metrics.NewUniformSample(1028)),
+		},
+	}
+	return c, nil
+}
+
+// Open does nothing, since connections are made as batches are exported.
+func (c *Client) Open() error {
+	return nil
+}
+
+// Write adds an event to the current batch, and exports the batch if it is full. If
+// exporting fails the event is removed from the batch again, so that the caller may
+// retry the Write.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	size := len(e.Message)
+	for k, v := range e.Fields {
+		size += len(k) + len(v)
+	}
+	c.pending = append(c.pending, e)
+	c.bytes += size
+	if len(c.pending) >= c.BatchMaxEvents || c.bytes >= c.BatchMaxBytes {
+		if err := c.Flush(); err != nil {
+			c.pending = c.pending[:len(c.pending)-1]
+			c.bytes -= size
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// Flush exports the current batch and blocks until the receiver has accepted it.
+func (c *Client) Flush() error {
+	if len(c.pending) == 0 {
+		return nil
+	}
+	body, err := c.encode()
+	if err != nil {
+		return err
+	}
+
+	err = c.sender.Retry(func() error {
+		return c.post(body)
+	}, func(error) {
+		c.retries.Inc(1)
+	})
+	c.lastErr = err
+	if err != nil {
+		return err
+	}
+	c.batchSize.Update(int64(len(c.pending)))
+	c.pending = nil
+	c.bytes = 0
+	return nil
+}
+
+// Close discards any events that have not been exported.
+func (c *Client) Close() error {
+	c.pending = nil
+	c.bytes = 0
+	return nil
+}
+
+// Health returns the error of the last batch that failed for good, if no batch has
+// been exported since.
+func (c *Client) Health() error {
+	return c.lastErr
+}
+
+// encode returns the current batch as an ExportLogsServiceRequest in the configured
+// format, compressed if compression is enabled.
+func (c *Client) encode() ([]byte, error) {
+	all := newResourceLogs(c.pending, time.Now())
+	var body []byte
+	var err error
+	if c.Format == "json" {
+		body, err = encodeJSON(all)
+	} else {
+		body, err = encodeProto(all)
+	}
+	if err != nil || c.Compression != "gzip" {
+		return body, err
+	}
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return compressed.Bytes(), nil
+}
+
+// post sends one export request.
+func (c *Client) post(body []byte) error {
+	req, err := http.NewRequest("POST", c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.Format == "json" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-protobuf")
+	}
+	if c.Compression == "gzip" {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	for name, v := range c.Headers {
+		req.Header.Set(name, v)
+	}
+
+	c.requests.Inc(1)
+	resp, err := c.sender.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil // the batch was accepted all the same
+	}
+	c.checkPartialSuccess(msg)
+	return nil
+}
+
+// checkPartialSuccess logs and counts the records a successful response reports as
+// rejected. Rejected records are not retried, since the receiver will not accept
+// them.
+func (c *Client) checkPartialSuccess(body []byte) {
+	decode := decodeResponseProto
+	if c.Format == "json" {
+		decode = decodeResponseJSON
+	}
+	ps, err := decode(body)
+	if err != nil {
+		log.Printf("Error decoding OTLP response: %s", err)
+		return
+	}
+	if ps.RejectedLogRecords > 0 || ps.ErrorMessage != "" {
+		c.rejected.Inc(ps.RejectedLogRecords)
+		log.Printf("OTLP receiver rejected %d log records: %s", ps.RejectedLogRecords, ps.ErrorMessage)
+	}
+}
@@ -0,0 +1,276 @@
+package otlp
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func journalEvent(host string) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Unix(1470830400, 5))
+	e.Message = "Started nginx"
+	e.Fields["PRIORITY"] = "3"
+	e.Fields["_HOSTNAME"] = host
+	e.Fields["_MACHINE_ID"] = "m1"
+	e.Fields["_SYSTEMD_UNIT"] = "nginx.service"
+	return e
+}
+
+func TestNewResourceLogs(t *testing.T) {
+	observed := time.Unix(1470830401, 0)
+	other := journalEvent("web2")
+	other.Fields["PRIORITY"] = "bogus"
+	all := newResourceLogs([]*logstash.V1Event{journalEvent("web1"), other, journalEvent("web1")}, observed)
+
+	assert.Equal(t, 2, len(all))
+	assert.Equal(t, []keyValue{{"host.name", "web1"}, {"host.id", "m1"}}, all[0].attributes)
+	assert.Equal(t, 2, len(all[0].records))
+	assert.Equal(t, logRecord{
+		time:         time.Unix(1470830400, 5).UTC(),
+		observed:     observed,
+		severity:     17,
+		severityText: "err",
+		body:         "Started nginx",
+		attributes:   []keyValue{{"PRIORITY", "3"}, {"_SYSTEMD_UNIT", "nginx.service"}},
+	}, all[0].records[0])
+	assert.Equal(t, 0, all[1].records[0].severity)
+}
+
+// wireFields returns the fields of a protobuf message by number, with varints and
+// fixed64s formatted in decimal, whatever order they were encoded in.
+func wireFields(t *testing.T, b []byte) map[protowire.Number][]string {
+	fields := map[protowire.Number][]string{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		assert.True(t, n > 0)
+		b = b[n:]
+		var v string
+		switch typ {
+		case protowire.BytesType:
+			data, n := protowire.ConsumeBytes(b)
+			assert.True(t, n > 0)
+			v, b = string(data), b[n:]
+		case protowire.VarintType:
+			x, n := protowire.ConsumeVarint(b)
+			assert.True(t, n > 0)
+			v, b = strconv.FormatUint(x, 10), b[n:]
+		case protowire.Fixed64Type:
+			x, n := protowire.ConsumeFixed64(b)
+			assert.True(t, n > 0)
+			v, b = strconv.FormatUint(x, 10), b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+		fields[num] = append(fields[num], v)
+	}
+	return fields
+}
+
+func TestEncodeProto(t *testing.T) {
+	observed := time.Unix(1470830401, 0)
+	body, err := encodeProto(newResourceLogs([]*logstash.V1Event{journalEvent("web1")}, observed))
+	assert.Nil(t, err)
+
+	// ExportLogsServiceRequest.resource_logs
+	resourceLogs := wireFields(t, body)[1]
+	assert.Equal(t, 1, len(resourceLogs))
+	rl := wireFields(t, []byte(resourceLogs[0]))
+	// Resource.attributes
+	attributes := wireFields(t, []byte(rl[1][0]))[1]
+	assert.Equal(t, 2, len(attributes))
+	kv := wireFields(t, []byte(attributes[0]))
+	assert.Equal(t, []string{"host.name"}, kv[1])
+	assert.Equal(t, map[protowire.Number][]string{1: {"web1"}}, wireFields(t, []byte(kv[2][0])))
+	// ScopeLogs.scope and log_records
+	sl := wireFields(t, []byte(rl[2][0]))
+	assert.Equal(t, map[protowire.Number][]string{1: {scopeName}}, wireFields(t, []byte(sl[1][0])))
+	assert.Equal(t, 1, len(sl[2]))
+	record := wireFields(t, []byte(sl[2][0]))
+	assert.Equal(t, []string{"1470830400000000005"}, record[1])
+	assert.Equal(t, []string{"1470830401000000000"}, record[11])
+	assert.Equal(t, []string{"17"}, record[2])
+	assert.Equal(t, []string{"err"}, record[3])
+	assert.Equal(t, map[protowire.Number][]string{1: {"Started nginx"}}, wireFields(t, []byte(record[5][0])))
+	assert.Equal(t, 2, len(record[6]))
+}
+
+// protoResponse returns an ExportLogsServiceResponse with a partial success.
+func protoResponse(rejected uint64, msg string) []byte {
+	var ps []byte
+	ps = protowire.AppendTag(ps, 1, protowire.VarintType)
+	ps = protowire.AppendVarint(ps, rejected)
+	ps = protowire.AppendTag(ps, 2, protowire.BytesType)
+	ps = protowire.AppendString(ps, msg)
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	return protowire.AppendBytes(b, ps)
+}
+
+func TestDecodeResponse(t *testing.T) {
+	ps, err := decodeResponseJSON([]byte(`{"partialSuccess":{"rejectedLogRecords":"2","errorMessage":"too big"}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, partialSuccess{2, "too big"}, ps)
+	ps, err = decodeResponseJSON([]byte(`{"partialSuccess":{"rejectedLogRecords":3}}`))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), ps.RejectedLogRecords)
+	ps, err = decodeResponseJSON(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, partialSuccess{}, ps)
+	_, err = decodeResponseJSON([]byte(`{"partialSuccess":`))
+	assert.NotNil(t, err)
+
+	ps, err = decodeResponseProto(protoResponse(2, "too big"))
+	assert.Nil(t, err)
+	assert.Equal(t, partialSuccess{2, "too big"}, ps)
+	ps, err = decodeResponseProto(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, partialSuccess{}, ps)
+	_, err = decodeResponseProto([]byte{0x0a, 0x05})
+	assert.NotNil(t, err)
+}
+
+func TestNewClient(t *testing.T) {
+	c, err := NewClient(Config{URL: "http://collector:4318"})
+	assert.Nil(t, err)
+	assert.Equal(t, "http://collector:4318/v1/logs", c.URL)
+	assert.Equal(t, "gzip", c.Compression)
+	assert.Equal(t, "protobuf", c.Format)
+
+	_, err = NewClient(Config{URL: "collector:4318"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "http://collector:4318", Compression: "zstd"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "http://collector:4318", Format: "xml"})
+	assert.NotNil(t, err)
+}
+
+// collectorStandIn records the requests it receives, decoding those in OTLP/JSON. It
+// answers the first request with status, if set, and otherwise with response.
+type collectorStandIn struct {
+	sync.Mutex
+	status     int
+	retryAfter string
+	response   string
+	requests   []map[string]interface{}
+	bodies     [][]byte
+	headers    []http.Header
+}
+
+func (s *collectorStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		body, _ = gzip.NewReader(r.Body)
+	}
+	b, _ := ioutil.ReadAll(body)
+	var req map[string]interface{}
+	json.Unmarshal(b, &req)
+	s.requests = append(s.requests, req)
+	s.bodies = append(s.bodies, b)
+	s.headers = append(s.headers, r.Header)
+	if s.status != 0 {
+		w.Header().Set("Retry-After", s.retryAfter)
+		w.WriteHeader(s.status)
+		s.status = 0
+		return
+	}
+	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+	w.Write([]byte(s.response))
+}
+
+func TestWrite__json(t *testing.T) {
+	standIn := &collectorStandIn{response: `{"partialSuccess":{"rejectedLogRecords":"1","errorMessage":"dropped"}}`}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{
+		URL:            server.URL,
+		Headers:        map[string]string{"Authorization": "Bearer token"},
+		Format:         "json",
+		BatchMaxEvents: 2,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+	rejected := c.rejected.Count()
+
+	_, err = c.Write(journalEvent("web1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(standIn.requests))
+	_, err = c.Write(journalEvent("web2"))
+	assert.Nil(t, err)
+
+	// the batch was full, so it was exported by the second Write
+	assert.Equal(t, 1, len(standIn.requests))
+	h := standIn.headers[0]
+	assert.Equal(t, "application/json", h.Get("Content-Type"))
+	assert.Equal(t, "gzip", h.Get("Content-Encoding"))
+	assert.Equal(t, "Bearer token", h.Get("Authorization"))
+	assert.Equal(t, rejected+1, c.rejected.Count())
+
+	resourceLogs := standIn.requests[0]["resourceLogs"].([]interface{})
+	assert.Equal(t, 2, len(resourceLogs))
+	scopeLogs := resourceLogs[0].(map[string]interface{})["scopeLogs"].([]interface{})
+	record := scopeLogs[0].(map[string]interface{})["logRecords"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "1470830400000000005", record["timeUnixNano"])
+	assert.Equal(t, float64(17), record["severityNumber"])
+	assert.Equal(t, map[string]interface{}{"stringValue": "Started nginx"}, record["body"])
+}
+
+func TestWrite__protobuf(t *testing.T) {
+	standIn := &collectorStandIn{response: string(protoResponse(1, "dropped"))}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, Compression: "none", BatchMaxEvents: 1})
+	assert.Nil(t, err)
+	rejected := c.rejected.Count()
+
+	_, err = c.Write(journalEvent("web1"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(standIn.bodies))
+	assert.Equal(t, "application/x-protobuf", standIn.headers[0].Get("Content-Type"))
+	assert.Equal(t, rejected+1, c.rejected.Count())
+	assert.Equal(t, 1, len(wireFields(t, standIn.bodies[0])[1]))
+}
+
+func TestFlush__retryAfter(t *testing.T) {
+	standIn := &collectorStandIn{status: http.StatusServiceUnavailable, retryAfter: "1"}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, Compression: "none"})
+	assert.Nil(t, err)
+	c.Write(journalEvent("web1"))
+	start := time.Now()
+	assert.Nil(t, c.Flush())
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.Equal(t, 2, len(standIn.requests))
+	assert.Equal(t, "", standIn.headers[0].Get("Content-Encoding"))
+}
+
+func TestFlush__badRequest(t *testing.T) {
+	standIn := &collectorStandIn{status: http.StatusBadRequest}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, BatchMaxEvents: 1})
+	assert.Nil(t, err)
+	_, err = c.Write(journalEvent("web1"))
+	assert.NotNil(t, err)
+	assert.NotNil(t, c.Health())
+	// the event was taken out of the batch, for the caller to retry
+	assert.Equal(t, 0, len(c.pending))
+	assert.Equal(t, 1, len(standIn.requests))
+}
@@ -0,0 +1,25 @@
+// Package output defines the interface implemented by the destinations that
+// journal-2-logstash can ship journal events to.
+package output
+
+import (
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+)
+
+// Output is a destination for Logstash V1Events read from the journal.
+//
+// The JournalShipper calls Open once before the main loop starts, Write for every
+// event read from the journal, and Flush before persisting the journal cursor to the
+// state file. An Output that buffers or batches events must not return from Flush
+// until every event previously passed to Write has been delivered, because the
+// shipper treats a successful Flush as permission to advance the saved cursor.
+//
+// Health returns nil when the Output believes it can deliver events, or an error
+// describing why it cannot.
+type Output interface {
+	Open() error
+	Write(e *logstash.V1Event) (int, error)
+	Flush() error
+	Close() error
+	Health() error
+}
@@ -0,0 +1,77 @@
+package output
+
+import (
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+)
+
+// Tee is an Output that writes every event to several outputs, such as a local file
+// alongside a network destination.
+//
+// Flush flushes every output, so the shipper only advances the journal cursor once
+// all of them have delivered an event. A failed Write may leave the event written to
+// some of the outputs.
+type Tee struct {
+	outs []Output
+}
+
+// NewTee returns a Tee writing to outs, in order.
+func NewTee(outs ...Output) *Tee {
+	return &Tee{outs: outs}
+}
+
+// Open opens each output.
+func (t *Tee) Open() error {
+	for _, out := range t.outs {
+		if err := out.Open(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write writes an event to each output, stopping at the first error. It returns the
+// bytes written by the first output.
+func (t *Tee) Write(e *logstash.V1Event) (int, error) {
+	var written int
+	for i, out := range t.outs {
+		n, err := out.Write(e)
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			written = n
+		}
+	}
+	return written, nil
+}
+
+// Flush flushes each output, stopping at the first error.
+func (t *Tee) Flush() error {
+	for _, out := range t.outs {
+		if err := out.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes every output and returns the first error.
+func (t *Tee) Close() error {
+	var first error
+	for _, out := range t.outs {
+		if err := out.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Health returns the first unhealthy output's error.
+func (t *Tee) Health() error {
+	for _, out := range t.outs {
+		if err := out.Health(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+// Package splunkhec implements an output that sends batches of events to a Splunk HTTP
+// Event Collector (HEC).
+//
+// Each event is wrapped in an HEC event whose time is the journal's
+// __REALTIME_TIMESTAMP and whose host is _HOSTNAME. Its sourcetype and index are chosen
+// by the first Rule matching the event's _SYSTEMD_UNIT.
+//
+// With indexer acknowledgement enabled on the HEC token, Flush blocks until Splunk has
+// acknowledged every batch sent, so the journal cursor only advances past events that
+// have been indexed. Batches not acknowledged within AckTimeout are sent again, so an
+// event may occasionally be indexed twice.
+package splunkhec
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/httpoutput"
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DefaultSourcetype is the sourcetype of events no Rule matches.
+	DefaultSourcetype = "journald"
+
+	eventPath = "/services/collector/event"
+	ackPath   = "/services/collector/ack"
+
+	defaultBatchMaxEvents  = 500
+	defaultBatchMaxBytes   = 1 << 20
+	defaultAckTimeout      = time.Duration(5) * time.Minute
+	defaultAckPollInterval = time.Second
+)
+
+// Rule sets the sourcetype and index of events whose _SYSTEMD_UNIT matches Unit, a
+// pattern as accepted by path.Match such as nginx*.service. An empty Sourcetype or
+// Index leaves the Config's default in place.
+type Rule struct {
+	Unit       string
+	Sourcetype string
+	Index      string
+}
+
+// ParseRule parses a rule given as unit=sourcetype or unit=sourcetype@index, such as
+// nginx*.service=nginx:access@web.
+func ParseRule(s string) (Rule, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return Rule{}, fmt.Errorf("invalid Splunk rule, expected unit=sourcetype[@index]: %s", s)
+	}
+	r := Rule{Unit: s[:i], Sourcetype: s[i+1:]}
+	if _, err := path.Match(r.Unit, ""); err != nil {
+		return Rule{}, fmt.Errorf("invalid unit pattern in Splunk rule %s: %s", s, err)
+	}
+	if j := strings.LastIndex(r.Sourcetype, "@"); j >= 0 {
+		r.Sourcetype, r.Index = r.Sourcetype[:j], r.Sourcetype[j+1:]
+	}
+	return r, nil
+}
+
+// Config holds the settings for a Splunk HEC Client.
+type Config struct {
+	// URL is the base URL of the HEC, such as https://splunk:8088.
+	URL string
+	// Token is the HEC token.
+	Token string
+	// TLSConfig is used for https URLs, or Go's defaults if nil.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// Sourcetype and Index apply to events no Rule matches. Sourcetype defaults to
+	// DefaultSourcetype; an empty Index leaves it to the token's default index.
+	Sourcetype string
+	Index      string
+	Rules      []Rule
+	// UseAck waits for indexer acknowledgement of each batch. It must match the
+	// token's setting in Splunk.
+	UseAck bool
+	// Channel identifies the client to the HEC. A random channel is used if empty.
+	Channel string
+	// AckTimeout is how long a batch may remain unacknowledged before it is sent again.
+	AckTimeout time.Duration
+	// AckPollInterval is how often Flush asks the HEC for acknowledgements.
+	AckPollInterval time.Duration
+	// BatchMaxEvents and BatchMaxBytes limit the size of a batch.
+	BatchMaxEvents int
+	BatchMaxBytes  int
+	// RetryMaxElapsed is how long a batch is retried, or waits for acknowledgement,
+	// before Flush gives up. A negative value retries for ever.
+	RetryMaxElapsed time.Duration
+}
+
+// Client sends Logstash V1Events to a Splunk HEC.
+//
+// Write adds events to a batch, which is sent once it is full. Flush sends a partially
+// filled batch and, with UseAck, waits until every batch sent has been acknowledged.
+// Responses 429, 503 and other 5xx, and network errors, are retried, while other
+// responses fail the batch.
+type Client struct {
+	Config
+	sender  *httpoutput.Sender
+	pending bytes.Buffer
+	events  int
+	unacked map[int64][]byte // batches sent but not yet acknowledged, by ack ID
+	lastErr error
+	clientMetrics
+}
+
+type clientMetrics struct {
+	requests  metrics.Counter
+	retries   metrics.Counter
+	resends   metrics.Counter
+	batchSize metrics.Histogram
+}
+
+// hecEvent is the envelope of an event sent to the HEC.
+type hecEvent struct {
+	Time       json.Number     `json:"time"`
+	Host       string          `json:"host,omitempty"`
+	Sourcetype string          `json:"sourcetype,omitempty"`
+	Index      string          `json:"index,omitempty"`
+	Event      json.RawMessage `json:"event"`
+}
+
+// hecResponse is the HEC's answer to a batch.
+type hecResponse struct {
+	Text  string `json:"text"`
+	Code  int    `json:"code"`
+	AckID *int64 `json:"ackId"`
+}
+
+// NewClient returns a Client object. Connections are made when the first batch is sent.
+func NewClient(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("splunk HEC URL must start with http:// or https://: %s", cfg.URL)
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.Token == "" {
+		return nil, errors.New("a Splunk HEC token is required")
+	}
+	if cfg.Sourcetype == "" {
+		cfg.Sourcetype = DefaultSourcetype
+	}
+	if cfg.UseAck && cfg.Channel == "" {
+		if cfg.Channel, err = newChannel(); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AckTimeout == 0 {
+		cfg.AckTimeout = defaultAckTimeout
+	}
+	if cfg.AckPollInterval == 0 {
+		cfg.AckPollInterval = defaultAckPollInterval
+	}
+	if cfg.BatchMaxEvents == 0 {
+		cfg.BatchMaxEvents = defaultBatchMaxEvents
+	}
+	if cfg.BatchMaxBytes == 0 {
+		cfg.BatchMaxBytes = defaultBatchMaxBytes
+	}
+
+	c := &Client{
+		Config: cfg,
+		sender: httpoutput.NewSender(httpoutput.Config{
+			Name:        "splunk",
+			TLSConfig:   cfg.TLSConfig,
+			Timeout:     cfg.Timeout,
+			RetryPolicy: logstash.RetryPolicy{MaxElapsed: cfg.RetryMaxElapsed},
+		}),
+		unacked: map[int64][]byte{},
+		clientMetrics: clientMetrics{
+			requests:  metrics.GetOrRegisterCounter("splunk_hec_requests", metrics.DefaultRegistry),
+			retries:   metrics.GetOrRegisterCounter("splunk_hec_retries", metrics.DefaultRegistry),
+			resends:   metrics.GetOrRegisterCounter("splunk_hec_ack_resends", metrics.DefaultRegistry),
+			batchSize: metrics.GetOrRegisterHistogram("splunk_hec_batch_size", metrics.DefaultRegistry, metrics.NewUniformSample(1028)),
+		},
+	}
+	return c, nil
+}
+
+// newChannel returns a random UUID, as the HEC expects channels to be.
+func newChannel() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// Open does nothing, since connections are made as batches are sent.
+func (c *Client) Open() error {
+	return nil
+}
+
+// Write adds an event to the current batch, and sends the batch if it is full. If
+// sending fails the event is removed from the batch again, so that the caller may
+// retry the Write.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	b, err := c.encode(e)
+	if err != nil {
+		return 0, err
+	}
+	mark := c.pending.Len()
+	c.pending.Write(b)
+	c.pending.WriteByte('\n')
+	c.events++
+	if c.events >= c.BatchMaxEvents || c.pending.Len() >= c.BatchMaxBytes {
+		if err := c.send(); err != nil {
+			c.pending.Truncate(mark)
+			c.events--
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// Flush sends the current batch and blocks until the HEC has accepted it and, with
+// UseAck, until every batch sent has been acknowledged.
+func (c *Client) Flush() error {
+	if err := c.send(); err != nil {
+		return err
+	}
+	if err := c.waitForAcks(); err != nil {
+		c.lastErr = err
+		return err
+	}
+	c.lastErr = nil
+	return nil
+}
+
+// Close discards any events that have not been sent or acknowledged.
+func (c *Client) Close() error {
+	c.pending.Reset()
+	c.events = 0
+	c.unacked = map[int64][]byte{}
+	return nil
+}
+
+// Health returns the error of the last batch that failed for good, if no Flush has
+// succeeded since.
+func (c *Client) Health() error {
+	return c.lastErr
+}
+
+// encode wraps an event in an HEC event.
+func (c *Client) encode(e *logstash.V1Event) ([]byte, error) {
+	event, err := e.ToJSON()
+	if err != nil {
+		return nil, err
+	}
+	he := hecEvent{
+		Time:       json.Number(fmt.Sprintf("%d.%03d", e.Timestamp.Unix(), e.Timestamp.Nanosecond()/int(time.Millisecond))),
+		Host:       e.Fields["_HOSTNAME"],
+		Sourcetype: c.Sourcetype,
+		Index:      c.Index,
+		Event:      event,
+	}
+	unit := e.Fields["_SYSTEMD_UNIT"]
+	for _, r := range c.Rules {
+		if ok, _ := path.Match(r.Unit, unit); ok {
+			if r.Sourcetype != "" {
+				he.Sourcetype = r.Sourcetype
+			}
+			if r.Index != "" {
+				he.Index = r.Index
+			}
+			break
+		}
+	}
+	return json.Marshal(he)
+}
+
+// send sends the current batch, retrying until the HEC accepts it. With UseAck the
+// batch is kept until it is acknowledged.
+func (c *Client) send() error {
+	if c.events == 0 {
+		return nil
+	}
+	body := append([]byte(nil), c.pending.Bytes()...)
+	ackID, err := c.sendBatch(body)
+	c.lastErr = err
+	if err != nil {
+		return err
+	}
+	if c.UseAck {
+		c.unacked[ackID] = body
+	}
+	c.batchSize.Update(int64(c.events))
+	c.pending.Reset()
+	c.events = 0
+	return nil
+}
+
+// sendBatch POSTs a batch with retries and returns its ack ID.
+func (c *Client) sendBatch(body []byte) (int64, error) {
+	var resp hecResponse
+	err := c.sender.Retry(func() error {
+		resp = hecResponse{}
+		return c.post(eventPath, body, &resp)
+	}, func(error) {
+		c.retries.Inc(1)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if c.UseAck && resp.AckID == nil {
+		return 0, errors.New("splunk did not return an ackId; is indexer acknowledgement enabled on the HEC token?")
+	}
+	if resp.AckID != nil {
+		return *resp.AckID, nil
+	}
+	return 0, nil
+}
+
+// waitForAcks polls the HEC until every batch sent has been acknowledged. Batches
+// still unacknowledged after AckTimeout are sent again.
+func (c *Client) waitForAcks() error {
+	start := time.Now()
+	deadline := start.Add(c.AckTimeout)
+	for len(c.unacked) > 0 {
+		time.Sleep(c.AckPollInterval)
+
+		ids := make([]int64, 0, len(c.unacked))
+		for id := range c.unacked {
+			ids = append(ids, id)
+		}
+		req, _ := json.Marshal(map[string][]int64{"acks": ids})
+		var resp struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		err := c.post(ackPath, req, &resp)
+		if err != nil && !c.sender.Retryable(err) {
+			return err
+		}
+		if err != nil {
+			log.Printf("Error querying splunk for acknowledgements: %s", err)
+		}
+		for id, acked := range resp.Acks {
+			n, err := strconv.ParseInt(id, 10, 64)
+			if err == nil && acked {
+				delete(c.unacked, n)
+			}
+		}
+
+		if len(c.unacked) == 0 || time.Now().Before(deadline) {
+			continue
+		}
+		if maxElapsed := c.sender.RetryPolicy.MaxElapsed; maxElapsed >= 0 && time.Since(start) > maxElapsed {
+			return fmt.Errorf("giving up after %s: %d batches not acknowledged by splunk", maxElapsed, len(c.unacked))
+		}
+		log.Printf("%d batches not acknowledged by splunk within %s, sending them again", len(c.unacked), c.AckTimeout)
+		unacked := c.unacked
+		c.unacked = map[int64][]byte{}
+		for _, body := range unacked {
+			id, err := c.sendBatch(body)
+			if err != nil {
+				return err
+			}
+			c.resends.Inc(1)
+			c.unacked[id] = body
+		}
+		deadline = time.Now().Add(c.AckTimeout)
+	}
+	return nil
+}
+
+// post sends one request to the HEC and decodes its JSON response into v.
+func (c *Client) post(endpoint string, body []byte, v interface{}) error {
+	req, err := http.NewRequest("POST", c.URL+endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Splunk "+c.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if c.Channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", c.Channel)
+	}
+
+	c.requests.Inc(1)
+	resp, err := c.sender.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
@@ -0,0 +1,243 @@
+package splunkhec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+// hecStandIn records the events POSTed to it. With ack enabled, it acknowledges each
+// batch once it has been asked about it ackAfter times, or never if ackAfter < 0.
+type hecStandIn struct {
+	sync.Mutex
+	t        *testing.T
+	ack      bool
+	ackAfter int
+	status   int // answered to the first batch, if set
+	batches  [][]map[string]interface{}
+	queries  map[int64]int
+	channel  string
+}
+
+func (h *hecStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if r.Header.Get("Authorization") != "Splunk secret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"text":"Invalid token","code":4}`)
+		return
+	}
+	h.channel = r.Header.Get("X-Splunk-Request-Channel")
+	body, _ := ioutil.ReadAll(r.Body)
+
+	switch r.URL.Path {
+	case "/services/collector/event":
+		if h.status != 0 {
+			w.WriteHeader(h.status)
+			h.status = 0
+			fmt.Fprint(w, `{"text":"Server is busy","code":9}`)
+			return
+		}
+		var batch []map[string]interface{}
+		s := bufio.NewScanner(bytes.NewReader(body))
+		for s.Scan() {
+			var event map[string]interface{}
+			assert.Nil(h.t, json.Unmarshal(s.Bytes(), &event))
+			batch = append(batch, event)
+		}
+		h.batches = append(h.batches, batch)
+		if h.ack {
+			fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, len(h.batches)-1)
+		} else {
+			fmt.Fprint(w, `{"text":"Success","code":0}`)
+		}
+	case "/services/collector/ack":
+		var req struct {
+			Acks []int64 `json:"acks"`
+		}
+		json.Unmarshal(body, &req)
+		acks := map[string]bool{}
+		for _, id := range req.Acks {
+			h.queries[id]++
+			acks[fmt.Sprint(id)] = h.ackAfter >= 0 && h.queries[id] > h.ackAfter
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"acks": acks})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func newStandIn(t *testing.T) (*hecStandIn, *httptest.Server) {
+	h := &hecStandIn{t: t, queries: map[int64]int{}}
+	return h, httptest.NewServer(h)
+}
+
+func journalEvent(unit string) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 250000000, time.UTC))
+	e.Message = "hello"
+	e.Fields["_HOSTNAME"] = "web1"
+	e.Fields["_SYSTEMD_UNIT"] = unit
+	return e
+}
+
+func TestParseRule(t *testing.T) {
+	r, err := ParseRule("nginx*.service=nginx:access@web")
+	assert.Nil(t, err)
+	assert.Equal(t, Rule{Unit: "nginx*.service", Sourcetype: "nginx:access", Index: "web"}, r)
+
+	r, err = ParseRule("sshd.service=@security")
+	assert.Nil(t, err)
+	assert.Equal(t, Rule{Unit: "sshd.service", Index: "security"}, r)
+
+	_, err = ParseRule("linux_secure")
+	assert.NotNil(t, err)
+	_, err = ParseRule("[.service=x")
+	assert.NotNil(t, err)
+}
+
+func TestNewClient(t *testing.T) {
+	c, err := NewClient(Config{URL: "https://splunk:8088/", Token: "secret", UseAck: true})
+	assert.Nil(t, err)
+	assert.Equal(t, "https://splunk:8088", c.URL)
+	assert.Equal(t, DefaultSourcetype, c.Sourcetype)
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", c.Channel)
+
+	_, err = NewClient(Config{URL: "https://splunk:8088"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{URL: "splunk:8088", Token: "secret"})
+	assert.NotNil(t, err)
+}
+
+func TestWrite(t *testing.T) {
+	standIn, server := newStandIn(t)
+	defer server.Close()
+
+	c, err := NewClient(Config{
+		URL:   server.URL,
+		Token: "secret",
+		Index: "main",
+		Rules: []Rule{
+			{Unit: "nginx*.service", Sourcetype: "nginx:access"},
+			{Unit: "sshd.service", Index: "security"},
+		},
+		BatchMaxEvents: 2,
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+
+	for _, unit := range []string{"nginx-web.service", "sshd.service", "cron.service"} {
+		_, err := c.Write(journalEvent(unit))
+		assert.Nil(t, err)
+	}
+	// the first two events filled a batch
+	assert.Equal(t, 1, len(standIn.batches))
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 2, len(standIn.batches))
+	assert.Equal(t, "", standIn.channel)
+
+	events := append(standIn.batches[0], standIn.batches[1]...)
+	assert.Equal(t, 1470830400.25, events[0]["time"])
+	assert.Equal(t, "web1", events[0]["host"])
+	assert.Equal(t, "nginx:access", events[0]["sourcetype"])
+	assert.Equal(t, "main", events[0]["index"])
+	assert.Equal(t, "hello", events[0]["event"].(map[string]interface{})["message"])
+	assert.Equal(t, "journald", events[1]["sourcetype"])
+	assert.Equal(t, "security", events[1]["index"])
+	assert.Equal(t, "journald", events[2]["sourcetype"])
+	assert.Equal(t, "main", events[2]["index"])
+}
+
+func TestFlush__ack(t *testing.T) {
+	standIn, server := newStandIn(t)
+	defer server.Close()
+	standIn.ack = true
+	standIn.ackAfter = 2
+
+	c, err := NewClient(Config{URL: server.URL, Token: "secret", UseAck: true, AckPollInterval: time.Millisecond, BatchMaxEvents: 1})
+	assert.Nil(t, err)
+	c.Write(journalEvent("a.service"))
+	c.Write(journalEvent("b.service"))
+	assert.Equal(t, 2, len(c.unacked))
+
+	// Flush returns once both batches have been acknowledged
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 0, len(c.unacked))
+	assert.Equal(t, 3, standIn.queries[0])
+	assert.Equal(t, 3, standIn.queries[1])
+	assert.Equal(t, c.Channel, standIn.channel)
+}
+
+func TestFlush__ackTimeout(t *testing.T) {
+	standIn, server := newStandIn(t)
+	defer server.Close()
+	standIn.ack = true
+	standIn.ackAfter = -1
+
+	c, err := NewClient(Config{
+		URL:             server.URL,
+		Token:           "secret",
+		UseAck:          true,
+		AckPollInterval: time.Millisecond,
+		AckTimeout:      5 * time.Millisecond,
+		RetryMaxElapsed: 50 * time.Millisecond,
+	})
+	assert.Nil(t, err)
+	c.Write(journalEvent("a.service"))
+
+	// the unacknowledged batch is sent again until Flush gives up
+	assert.NotNil(t, c.Flush())
+	assert.NotNil(t, c.Health())
+	assert.True(t, len(standIn.batches) > 1)
+	assert.Equal(t, standIn.batches[0], standIn.batches[1])
+}
+
+func TestFlush__retry(t *testing.T) {
+	standIn, server := newStandIn(t)
+	defer server.Close()
+	standIn.status = http.StatusServiceUnavailable
+
+	c, err := NewClient(Config{URL: server.URL, Token: "secret"})
+	assert.Nil(t, err)
+	c.Write(journalEvent("a.service"))
+	assert.Nil(t, c.Flush())
+	assert.Equal(t, 1, len(standIn.batches))
+}
+
+func TestFlush__badToken(t *testing.T) {
+	_, server := newStandIn(t)
+	defer server.Close()
+
+	c, err := NewClient(Config{URL: server.URL, Token: "wrong", BatchMaxEvents: 1})
+	assert.Nil(t, err)
+	_, err = c.Write(journalEvent("a.service"))
+	assert.NotNil(t, err)
+	assert.NotNil(t, c.Health())
+	// the event was taken out of the batch, for the caller to retry
+	assert.Equal(t, 0, c.events)
+	assert.Equal(t, 0, c.pending.Len())
+	// with nothing left to deliver, the client is healthy again once flushed
+	assert.Nil(t, c.Flush())
+	assert.Nil(t, c.Health())
+}
+
+func TestEncode__subSecond(t *testing.T) {
+	c, err := NewClient(Config{URL: "https://splunk:8088", Token: "secret"})
+	assert.Nil(t, err)
+	e := journalEvent("a.service")
+	// __REALTIME_TIMESTAMP 1460858962473842
+	e.SetTimestamp(time.Unix(1460858962, 473842000))
+	b, err := c.encode(e)
+	assert.Nil(t, err)
+	assert.Contains(t, string(b), `"time":1460858962.473,`)
+}
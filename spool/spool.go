@@ -0,0 +1,493 @@
+// Package spool implements a disk-backed queue that sits in front of another output.
+//
+// Events written to a Spool are appended to segment files on disk and delivered to the
+// wrapped output, in order, by a background goroutine. When the wrapped output is
+// unreachable events accumulate on disk, up to a size cap, instead of blocking the
+// journal reader.
+package spool
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/pantheon-systems/journal-2-logstash/output"
+	"github.com/rcrowley/go-metrics"
+)
+
+// Overflow policies, applied when a Write would grow the spool beyond MaxBytes.
+const (
+	// OverflowDropOldest deletes the oldest segment, discarding its undelivered events.
+	OverflowDropOldest = "drop-oldest"
+	// OverflowBlock blocks Write until the wrapped output has drained enough events.
+	OverflowBlock = "block"
+)
+
+const (
+	segmentSuffix = ".seg"
+	// records are prefixed with their length as a big-endian uint32
+	recordHeaderLen = 4
+)
+
+var (
+	// closeTimeout bounds how long Close waits for an in-flight delivery to the wrapped output.
+	closeTimeout = time.Duration(10) * time.Second
+)
+
+// Config holds the settings for a Spool.
+type Config struct {
+	Dir          string
+	MaxBytes     int64
+	SegmentBytes int64
+	Overflow     string
+	// Retry spaces the attempts to deliver spooled events to the wrapped output. They
+	// are retried for ever, whatever its MaxElapsed and MaxAttempts, since they are
+	// safe on disk in the meantime.
+	Retry logstash.RetryPolicy
+}
+
+type segment struct {
+	id     int64
+	bytes  int64
+	events int64
+}
+
+// Spool is an output.Output that stores events on disk and forwards them to another output.
+//
+// Flush syncs the current segment to disk. Once Flush returns the spooled events survive
+// a restart, so the shipper may advance the journal cursor past them. Events are
+// delivered to the wrapped output at least once; a segment that was partially
+// delivered before a restart is delivered again from its beginning.
+type Spool struct {
+	Config
+	out output.Output
+
+	sync.Mutex
+	cond     *sync.Cond
+	segments []*segment // oldest first. The last segment is being written to.
+	writer   *os.File
+	// read position of the drain goroutine within segments[0]
+	readOffset int64
+	readEvents int64
+	depth      int64
+	closed     bool
+	lastErr    error
+	stop       chan struct{}
+	done       chan struct{}
+	spoolMetrics
+}
+
+type spoolMetrics struct {
+	events  metrics.Gauge
+	bytes   metrics.Gauge
+	dropped metrics.Counter
+}
+
+// New returns a Spool that delivers events to out. The spool directory is opened, and
+// the drain goroutine started, by Open.
+func New(cfg Config, out output.Output) (*Spool, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("spool directory is required")
+	}
+	if cfg.SegmentBytes < 1 || cfg.MaxBytes < 2*cfg.SegmentBytes {
+		return nil, fmt.Errorf("spool max bytes (%d) must be at least twice the segment size (%d)", cfg.MaxBytes, cfg.SegmentBytes)
+	}
+	if cfg.Overflow != OverflowDropOldest && cfg.Overflow != OverflowBlock {
+		return nil, fmt.Errorf("unknown spool overflow policy: %s", cfg.Overflow)
+	}
+	cfg.Retry = cfg.Retry.WithDefaults()
+	cfg.Retry.MaxElapsed = -1
+	cfg.Retry.MaxAttempts = 0
+	s := &Spool{
+		Config: cfg,
+		out:    out,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		spoolMetrics: spoolMetrics{
+			events:  metrics.GetOrRegisterGauge("spool_events", metrics.DefaultRegistry),
+			bytes:   metrics.GetOrRegisterGauge("spool_bytes", metrics.DefaultRegistry),
+			dropped: metrics.GetOrRegisterCounter("spool_dropped", metrics.DefaultRegistry),
+		},
+	}
+	s.cond = sync.NewCond(s)
+	return s, nil
+}
+
+// Open loads any segments left in the spool directory by a previous run, starts a new
+// segment for writing and starts delivering events to the wrapped output. Open does
+// not wait for the wrapped output to connect.
+func (s *Spool) Open() error {
+	if err := os.MkdirAll(s.Dir, 0700); err != nil {
+		return err
+	}
+	segments, err := loadSegments(s.Dir)
+	if err != nil {
+		return err
+	}
+	var nextID int64 = 1
+	for _, seg := range segments {
+		s.depth += seg.events
+		nextID = seg.id + 1
+	}
+	if len(segments) > 0 {
+		log.Printf("Loaded %d events from spool %s", s.depth, s.Dir)
+	}
+	s.segments = segments
+	if err := s.newSegment(nextID); err != nil {
+		return err
+	}
+	s.updateMetrics()
+
+	go s.drain()
+	return nil
+}
+
+// Write appends an event to the current segment.
+func (s *Spool) Write(e *logstash.V1Event) (int, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return 0, err
+	}
+	record := make([]byte, recordHeaderLen+len(b))
+	binary.BigEndian.PutUint32(record, uint32(len(b)))
+	copy(record[recordHeaderLen:], b)
+	size := int64(len(record))
+
+	s.Lock()
+	defer s.Unlock()
+	for !s.closed && s.totalBytes()+size > s.MaxBytes && len(s.segments) > 1 {
+		if s.Overflow == OverflowBlock {
+			s.cond.Wait()
+			continue
+		}
+		if err := s.dropOldest(); err != nil {
+			return 0, err
+		}
+	}
+	if s.closed {
+		return 0, errors.New("spool is closed")
+	}
+
+	current := s.segments[len(s.segments)-1]
+	if current.bytes > 0 && current.bytes+size > s.SegmentBytes {
+		if err := s.newSegment(current.id + 1); err != nil {
+			return 0, err
+		}
+		current = s.segments[len(s.segments)-1]
+	}
+	if _, err := s.writer.Write(record); err != nil {
+		return 0, err
+	}
+	current.bytes += size
+	current.events++
+	s.depth++
+	s.updateMetrics()
+	s.cond.Broadcast()
+	return len(b), nil
+}
+
+// Flush syncs the current segment to disk.
+func (s *Spool) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	return s.writer.Sync()
+}
+
+// Close stops delivering events, closes the wrapped output and closes the current
+// segment. Undelivered events remain on disk for the next run.
+func (s *Spool) Close() error {
+	s.Lock()
+	if s.closed {
+		s.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.stop)
+	s.cond.Broadcast()
+	opened := s.writer != nil
+	s.Unlock()
+
+	if opened {
+		select {
+		case <-s.done:
+		case <-time.After(closeTimeout):
+			log.Printf("Timed out waiting for spool to finish delivering an event")
+		}
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+	return err
+}
+
+// Health returns the last error returned by the wrapped output, or nil if the last
+// delivery succeeded.
+func (s *Spool) Health() error {
+	s.Lock()
+	defer s.Unlock()
+	return s.lastErr
+}
+
+func (s *Spool) totalBytes() int64 {
+	var total int64
+	for _, seg := range s.segments {
+		total += seg.bytes
+	}
+	return total
+}
+
+func (s *Spool) updateMetrics() {
+	s.events.Update(s.depth)
+	s.bytes.Update(s.totalBytes())
+}
+
+func (s *Spool) segmentPath(id int64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+}
+
+// newSegment closes the current segment, if any, and starts writing to a new one.
+func (s *Spool) newSegment(id int64) error {
+	f, err := os.OpenFile(s.segmentPath(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if s.writer != nil {
+		s.writer.Sync()
+		s.writer.Close()
+	}
+	s.writer = f
+	s.segments = append(s.segments, &segment{id: id})
+	return nil
+}
+
+// dropOldest deletes segments[0], including any of its events that have not been
+// delivered yet. It must not be called when segments[0] is being written to.
+func (s *Spool) dropOldest() error {
+	seg := s.segments[0]
+	if err := os.Remove(s.segmentPath(seg.id)); err != nil {
+		return err
+	}
+	dropped := seg.events - s.readEvents
+	log.Printf("Spool is full, dropped %d events", dropped)
+	s.dropped.Inc(dropped)
+	s.depth -= dropped
+	s.segments = s.segments[1:]
+	s.readOffset = 0
+	s.readEvents = 0
+	s.updateMetrics()
+	return nil
+}
+
+// drain runs in a goroutine, delivering events from the oldest segment to the
+// wrapped output and deleting segments once they have been delivered and flushed.
+func (s *Spool) drain() {
+	defer close(s.done)
+	defer s.out.Close()
+
+	var reader *os.File
+	var readerID int64
+	dirty := false
+
+	for {
+		s.Lock()
+		for !s.closed && s.readOffset >= s.segments[0].bytes && len(s.segments) == 1 && !dirty {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.Unlock()
+			break
+		}
+		seg := s.segments[0]
+		offset := s.readOffset
+		limit := seg.bytes
+		finished := offset >= limit && len(s.segments) > 1
+		s.Unlock()
+
+		if offset >= limit {
+			// caught up: make sure everything written to the output was delivered before
+			// waiting for more events or deleting the finished segment
+			if dirty {
+				if !s.retry(s.out.Flush) {
+					break
+				}
+				dirty = false
+			}
+			if finished {
+				s.Lock()
+				if len(s.segments) > 1 && s.segments[0] == seg {
+					os.Remove(s.segmentPath(seg.id))
+					s.segments = s.segments[1:]
+					s.readOffset = 0
+					s.readEvents = 0
+					s.updateMetrics()
+					s.cond.Broadcast()
+				}
+				s.Unlock()
+			}
+			continue
+		}
+
+		if reader == nil || readerID != seg.id {
+			if reader != nil {
+				reader.Close()
+			}
+			var err error
+			reader, err = os.Open(s.segmentPath(seg.id))
+			if err != nil {
+				// the segment was dropped while we were unlocked
+				reader = nil
+				continue
+			}
+			readerID = seg.id
+		}
+
+		e, n, err := readRecord(reader, offset, limit)
+		if err != nil {
+			log.Printf("Skipping unreadable remainder of spool segment %d: %s", seg.id, err)
+			n = limit - offset
+		} else if !s.retry(func() error {
+			if err := s.out.Open(); err != nil {
+				return err
+			}
+			_, err := s.out.Write(e)
+			return err
+		}) {
+			break
+		}
+		dirty = true
+
+		s.Lock()
+		if s.segments[0] == seg && s.readOffset == offset {
+			s.readOffset += n
+			if err == nil {
+				s.readEvents++
+				s.depth--
+			}
+			s.updateMetrics()
+		}
+		s.Unlock()
+	}
+	if reader != nil {
+		reader.Close()
+	}
+}
+
+// retry calls op until it succeeds, backing off between attempts as the retry policy
+// says. The wrapped output
+// is closed after each failure so that the next attempt reconnects. retry returns
+// false if the spool was closed before op succeeded.
+func (s *Spool) retry(op func() error) bool {
+	b := s.Retry.BackOff()
+	for {
+		err := op()
+		s.Lock()
+		s.lastErr = err
+		s.Unlock()
+		if err == nil {
+			return true
+		}
+		log.Printf("Error delivering spooled events, will retry: %s", err)
+		s.out.Close()
+		select {
+		case <-s.stop:
+			return false
+		case <-time.After(b.NextBackOff()):
+		}
+	}
+}
+
+// readRecord reads the record at offset from a segment and returns the event and the
+// number of bytes it occupied.
+func readRecord(r io.ReaderAt, offset, limit int64) (*logstash.V1Event, int64, error) {
+	header := make([]byte, recordHeaderLen)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		return nil, 0, err
+	}
+	n := int64(recordHeaderLen) + int64(binary.BigEndian.Uint32(header))
+	if offset+n > limit {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	b := make([]byte, n-recordHeaderLen)
+	if _, err := r.ReadAt(b, offset+recordHeaderLen); err != nil {
+		return nil, 0, err
+	}
+	e := &logstash.V1Event{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, 0, err
+	}
+	return e, n, nil
+}
+
+// loadSegments returns the segments in dir, oldest first. A segment that ends in a
+// partially written record, such as after a crash, is truncated to its last whole record.
+func loadSegments(dir string) ([]*segment, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := []*segment{}
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		seg := &segment{id: id}
+		for {
+			_, n, err := readRecord(f, seg.bytes, fi.Size())
+			if err != nil {
+				break
+			}
+			seg.bytes += n
+			seg.events++
+		}
+		f.Close()
+		if seg.bytes < fi.Size() {
+			log.Printf("Truncating partially written spool segment %s", path)
+			if err := os.Truncate(path, seg.bytes); err != nil {
+				return nil, err
+			}
+		}
+		if seg.events == 0 {
+			os.Remove(path)
+			continue
+		}
+		segments = append(segments, seg)
+	}
+	sort.Sort(byID(segments))
+	return segments, nil
+}
+
+type byID []*segment
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i].id < s[j].id }
@@ -0,0 +1,190 @@
+package spool
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOutput records the messages of the events written to it. While failing is set
+// every Write returns an error.
+type fakeOutput struct {
+	messages []string
+	failing  bool
+	sync.Mutex
+}
+
+func (o *fakeOutput) Open() error   { return nil }
+func (o *fakeOutput) Flush() error  { return nil }
+func (o *fakeOutput) Close() error  { return nil }
+func (o *fakeOutput) Health() error { return nil }
+
+func (o *fakeOutput) Write(e *logstash.V1Event) (int, error) {
+	o.Lock()
+	defer o.Unlock()
+	if o.failing {
+		return 0, errors.New("output is down")
+	}
+	o.messages = append(o.messages, e.Message)
+	return len(e.Message), nil
+}
+
+func (o *fakeOutput) setFailing(failing bool) {
+	o.Lock()
+	defer o.Unlock()
+	o.failing = failing
+}
+
+func (o *fakeOutput) Messages() []string {
+	o.Lock()
+	defer o.Unlock()
+	return append([]string{}, o.messages...)
+}
+
+func (o *fakeOutput) waitForMessages(t *testing.T, count int) []string {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if m := o.Messages(); len(m) >= count {
+			return m
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d messages but only received %d", count, len(o.Messages()))
+	return nil
+}
+
+func contains(messages []string, m string) bool {
+	for _, msg := range messages {
+		if msg == m {
+			return true
+		}
+	}
+	return false
+}
+
+func tempSpoolDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "journal_2_logstash_spool_tests")
+	assert.Nil(t, err)
+	return dir
+}
+
+func testEvent(i int) *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.Message = fmt.Sprintf("message %d", i)
+	return e
+}
+
+func TestSpool__deliversInOrder(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	out := &fakeOutput{}
+
+	s, err := New(Config{Dir: dir, MaxBytes: 1 << 20, SegmentBytes: 512, Overflow: OverflowDropOldest}, out)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Open())
+	for i := 0; i < 50; i++ {
+		_, err := s.Write(testEvent(i))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, s.Flush())
+
+	messages := out.waitForMessages(t, 50)
+	for i, m := range messages {
+		assert.Equal(t, fmt.Sprintf("message %d", i), m)
+	}
+	assert.Nil(t, s.Close())
+}
+
+func TestSpool__survivesRestart(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	cfg := Config{Dir: dir, MaxBytes: 1 << 20, SegmentBytes: 512, Overflow: OverflowDropOldest}
+
+	// the output is down for the whole first run
+	down := &fakeOutput{failing: true}
+	s, err := New(cfg, down)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Open())
+	for i := 0; i < 10; i++ {
+		s.Write(testEvent(i))
+	}
+	assert.Nil(t, s.Flush())
+	assert.Nil(t, s.Close())
+	assert.Empty(t, down.Messages())
+
+	out := &fakeOutput{}
+	s, err = New(cfg, out)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Open())
+	messages := out.waitForMessages(t, 10)
+	assert.Equal(t, "message 0", messages[0])
+	assert.Equal(t, "message 9", messages[9])
+	assert.Nil(t, s.Close())
+}
+
+func TestSpool__retryPolicy(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	out := &fakeOutput{failing: true}
+
+	// attempts are spaced by the policy, which never gives up on spooled events
+	s, err := New(Config{Dir: dir, MaxBytes: 1 << 20, SegmentBytes: 512, Overflow: OverflowDropOldest,
+		Retry: logstash.RetryPolicy{MaxElapsed: time.Millisecond, MaxAttempts: 1, InitialInterval: time.Millisecond, MaxInterval: 10 * time.Millisecond}}, out)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Open())
+	s.Write(testEvent(0))
+	assert.Nil(t, s.Flush())
+	time.Sleep(100 * time.Millisecond)
+	assert.NotNil(t, s.Health())
+
+	out.setFailing(false)
+	start := time.Now()
+	out.waitForMessages(t, 1)
+	assert.True(t, time.Since(start) < time.Second)
+	assert.Nil(t, s.Close())
+}
+
+func TestSpool__dropOldest(t *testing.T) {
+	dir := tempSpoolDir(t)
+	defer os.RemoveAll(dir)
+	out := &fakeOutput{failing: true}
+
+	s, err := New(Config{Dir: dir, MaxBytes: 2048, SegmentBytes: 512, Overflow: OverflowDropOldest}, out)
+	assert.Nil(t, err)
+	assert.Nil(t, s.Open())
+	for i := 0; i < 100; i++ {
+		_, err := s.Write(testEvent(i))
+		assert.Nil(t, err)
+	}
+	s.Lock()
+	assert.True(t, s.totalBytes() <= 2048)
+	s.Unlock()
+	assert.True(t, s.dropped.Count() > 0)
+
+	// once the output recovers the newest events are still delivered, but the
+	// dropped ones never are
+	out.setFailing(false)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && !contains(out.Messages(), "message 99") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	messages := out.Messages()
+	assert.Contains(t, messages, "message 99")
+	assert.NotContains(t, messages, "message 1")
+	assert.True(t, len(messages) < 100)
+	assert.Nil(t, s.Close())
+}
+
+func TestNew__invalidConfig(t *testing.T) {
+	_, err := New(Config{Dir: "/tmp", MaxBytes: 100, SegmentBytes: 100, Overflow: OverflowBlock}, &fakeOutput{})
+	assert.NotNil(t, err)
+	_, err = New(Config{Dir: "/tmp", MaxBytes: 1000, SegmentBytes: 100, Overflow: "explode"}, &fakeOutput{})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,143 @@
+// Package stdout implements an output that prints events instead of shipping them,
+// to see what the other outputs would send.
+package stdout
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+)
+
+// Formats accepted in Config.Format.
+const (
+	// FormatJSON prints each event as the compact JSON line the network outputs send.
+	FormatJSON = "json"
+	// FormatPretty prints each event as indented JSON.
+	FormatPretty = "pretty"
+	// FormatLine prints each event as one line in the style of journalctl.
+	FormatLine = "line"
+
+	lineTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// priorities are the syslog names of the PRIORITY levels.
+var priorities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// Config holds the settings for an Output.
+type Config struct {
+	// Format is FormatJSON, FormatPretty or FormatLine. It defaults to FormatJSON.
+	Format string
+	// Writer receives the rendered events, or os.Stdout if nil.
+	Writer io.Writer
+}
+
+// Output prints Logstash V1Events.
+//
+// Write buffers the rendered events and Flush writes them out, so that the shipper's
+// periodic flushes keep the output current.
+type Output struct {
+	Config
+	w *bufio.Writer
+}
+
+// New returns an Output.
+func New(cfg Config) (*Output, error) {
+	switch cfg.Format {
+	case "":
+		cfg.Format = FormatJSON
+	case FormatJSON, FormatPretty, FormatLine:
+	default:
+		return nil, fmt.Errorf("unknown stdout format: %s", cfg.Format)
+	}
+	if cfg.Writer == nil {
+		cfg.Writer = os.Stdout
+	}
+	return &Output{Config: cfg, w: bufio.NewWriter(cfg.Writer)}, nil
+}
+
+// Open does nothing.
+func (o *Output) Open() error {
+	return nil
+}
+
+// Write renders an event in the configured format.
+func (o *Output) Write(e *logstash.V1Event) (int, error) {
+	b, err := o.render(e)
+	if err != nil {
+		return 0, err
+	}
+	return o.w.Write(append(b, '\n'))
+}
+
+// Flush writes the buffered events out.
+func (o *Output) Flush() error {
+	return o.w.Flush()
+}
+
+// Close writes the buffered events out.
+func (o *Output) Close() error {
+	return o.w.Flush()
+}
+
+// Health always returns nil.
+func (o *Output) Health() error {
+	return nil
+}
+
+func (o *Output) render(e *logstash.V1Event) ([]byte, error) {
+	if o.Format == FormatLine {
+		return []byte(line(e)), nil
+	}
+	b, err := e.ToJSON()
+	if err != nil || o.Format == FormatJSON {
+		return b, err
+	}
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, b, "", "  "); err != nil {
+		return nil, err
+	}
+	return pretty.Bytes(), nil
+}
+
+// line renders an event like journalctl -o short-iso, with the priority added:
+//
+//	2016-08-10T12:00:00.000Z web1 nginx[1234] err: connect() failed
+//
+// Newlines in the message are escaped to keep each event on one line.
+func line(e *logstash.V1Event) string {
+	ident := e.Fields["SYSLOG_IDENTIFIER"]
+	if ident == "" {
+		ident = e.Fields["_COMM"]
+	}
+	if ident == "" {
+		ident = e.Fields["_SYSTEMD_UNIT"]
+	}
+	if ident == "" {
+		ident = "-"
+	}
+	if pid := e.Fields["_PID"]; pid != "" {
+		ident += "[" + pid + "]"
+	}
+	host := e.Fields["_HOSTNAME"]
+	if host == "" {
+		host = "-"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s", e.Timestamp.Format(lineTimeFormat), host, ident)
+	for i, name := range priorities {
+		if e.Fields["PRIORITY"] == fmt.Sprint(i) {
+			b.WriteString(" " + name)
+			break
+		}
+	}
+	b.WriteString(": ")
+	b.WriteString(strings.NewReplacer("\r", `\r`, "\n", `\n`).Replace(e.Message))
+	return b.String()
+}
@@ -0,0 +1,63 @@
+package stdout
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+func journalEvent() *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+	e.Message = "connect() failed\nretrying"
+	e.Fields["PRIORITY"] = "3"
+	e.Fields["SYSLOG_IDENTIFIER"] = "nginx"
+	e.Fields["_PID"] = "1234"
+	e.Fields["_HOSTNAME"] = "web1"
+	return e
+}
+
+func render(t *testing.T, format string, e *logstash.V1Event) string {
+	var buf bytes.Buffer
+	o, err := New(Config{Format: format, Writer: &buf})
+	assert.Nil(t, err)
+	_, err = o.Write(e)
+	assert.Nil(t, err)
+	// nothing is written out until Flush
+	assert.Equal(t, 0, buf.Len())
+	assert.Nil(t, o.Flush())
+	return buf.String()
+}
+
+func TestWrite__json(t *testing.T) {
+	e := journalEvent()
+	b, _ := e.ToJSON()
+	assert.Equal(t, string(b)+"\n", render(t, "", e))
+	assert.Equal(t, string(b)+"\n", render(t, FormatJSON, e))
+}
+
+func TestWrite__pretty(t *testing.T) {
+	out := render(t, FormatPretty, journalEvent())
+	assert.Contains(t, out, "{\n  \"@timestamp\": \"2016-08-10T12:00:00Z\",\n")
+	assert.Contains(t, out, "\n  \"_PID\": \"1234\",\n")
+}
+
+func TestWrite__line(t *testing.T) {
+	assert.Equal(t,
+		"2016-08-10T12:00:00.000Z web1 nginx[1234] err: connect() failed\\nretrying\n",
+		render(t, FormatLine, journalEvent()))
+
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+	e.Message = "hello"
+	e.Fields["_SYSTEMD_UNIT"] = "cron.service"
+	assert.Equal(t, "2016-08-10T12:00:00.000Z - cron.service: hello\n", render(t, FormatLine, e))
+}
+
+func TestNew__unknownFormat(t *testing.T) {
+	_, err := New(Config{Format: "yaml"})
+	assert.NotNil(t, err)
+}
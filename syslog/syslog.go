@@ -0,0 +1,225 @@
+// Package syslog implements an output that sends events as RFC 5424 syslog messages
+// over TLS, framed by octet counting as described in RFC 5425.
+//
+// Each message is preceded by its length in bytes and a space, so messages may
+// contain newlines. With a nil TLSConfig the same framing is sent over plain TCP, as
+// described in RFC 6587.
+package syslog
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/pantheon-systems/journal-2-logstash/netoutput"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	// DefaultFacility is the user-level facility, for events without SYSLOG_FACILITY.
+	DefaultFacility = 1
+	// DefaultSDID names the structured data element holding the selected journal
+	// fields. 32473 is the private enterprise number reserved for documentation by
+	// RFC 5612; set an SD-ID under your own enterprise number if the receiver cares.
+	DefaultSDID = "journal@32473"
+
+	defaultSeverity = 6 // informational
+	nilValue        = "-"
+	timestampFormat = "2006-01-02T15:04:05.000000Z07:00"
+)
+
+// Config holds the settings for a syslog Client.
+type Config struct {
+	// URL is the host:port of the syslog receiver.
+	URL string
+	// TLSConfig is used to connect to the receiver. If it is nil the client connects
+	// over plain TCP.
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// Host is the HOSTNAME of events without a _HOSTNAME field, or this machine's
+	// hostname if empty.
+	Host string
+	// Facility is the facility of events without a SYSLOG_FACILITY field. Zero is the
+	// kernel facility, so callers wanting the usual default set DefaultFacility.
+	Facility int
+	// SDID and StructuredDataFields select journal fields sent as the parameters of a
+	// structured data element. Fields an event lacks are left out.
+	SDID                 string
+	StructuredDataFields []string
+	// Retry is how connection attempts are retried.
+	Retry logstash.RetryPolicy
+}
+
+// Client sends Logstash V1Events to a syslog receiver.
+//
+// Write sends each event straight away, so Flush has nothing to do. A failed Write
+// reconnects and sends the event again, as the retry policy allows.
+type Client struct {
+	Config
+	conn *netoutput.Conn
+	sent metrics.Counter
+}
+
+// NewClient returns a Client object. The connection to the receiver is established by
+// Open, or lazily by the first Write.
+func NewClient(cfg Config) (*Client, error) {
+	if cfg.Facility < 0 || cfg.Facility > 23 {
+		return nil, fmt.Errorf("invalid syslog facility: %d", cfg.Facility)
+	}
+	if cfg.SDID == "" {
+		cfg.SDID = DefaultSDID
+	}
+	if !validSDName(cfg.SDID) {
+		return nil, fmt.Errorf("invalid syslog SD-ID: %s", cfg.SDID)
+	}
+	for _, f := range cfg.StructuredDataFields {
+		if !validSDName(f) {
+			return nil, fmt.Errorf("journal field %s cannot be a syslog structured data parameter", f)
+		}
+	}
+	if cfg.Host == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		cfg.Host = host
+	}
+	c := &Client{
+		Config: cfg,
+		conn: netoutput.New(netoutput.Config{
+			Name:        "syslog",
+			URL:         cfg.URL,
+			TLSConfig:   cfg.TLSConfig,
+			Timeout:     cfg.Timeout,
+			RetryPolicy: cfg.Retry,
+		}),
+		sent: metrics.GetOrRegisterCounter("syslog_messages_sent", metrics.DefaultRegistry),
+	}
+	return c, nil
+}
+
+// Open connects to the receiver if a connection is not already established.
+func (c *Client) Open() error {
+	return c.conn.Open()
+}
+
+// Write sends an event as an octet counted RFC 5424 message.
+func (c *Client) Write(e *logstash.V1Event) (int, error) {
+	msg := c.format(e)
+	frame := append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	if err := c.conn.Write(frame); err != nil {
+		return 0, err
+	}
+	c.sent.Inc(1)
+	return len(msg), nil
+}
+
+// Flush does nothing, since events are sent as they are written.
+func (c *Client) Flush() error {
+	return nil
+}
+
+// Close closes an active connection to the receiver.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Health returns an error if the client has no connection to the receiver.
+func (c *Client) Health() error {
+	return c.conn.Health()
+}
+
+// format renders an event as an RFC 5424 message. PRIORITY and SYSLOG_FACILITY make up
+// PRI, _HOSTNAME is HOSTNAME, SYSLOG_IDENTIFIER is APP-NAME and _PID is PROCID.
+func (c *Client) format(e *logstash.V1Event) []byte {
+	severity := field(e, "PRIORITY", 0, 7, defaultSeverity)
+	facility := field(e, "SYSLOG_FACILITY", 0, 23, c.Facility)
+
+	host := e.Fields["_HOSTNAME"]
+	if host == "" {
+		host = c.Host
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %s %s ",
+		facility*8+severity,
+		e.Timestamp.UTC().Format(timestampFormat),
+		header(host, 255),
+		header(e.Fields["SYSLOG_IDENTIFIER"], 48),
+		header(e.Fields["_PID"], 128),
+		nilValue, // MSGID
+	)
+
+	params := 0
+	for _, name := range c.StructuredDataFields {
+		v, ok := e.Fields[name]
+		if !ok {
+			continue
+		}
+		if params == 0 {
+			b.WriteString("[" + c.SDID)
+		}
+		params++
+		fmt.Fprintf(&b, ` %s="%s"`, name, sdEscaper.Replace(v))
+	}
+	if params > 0 {
+		b.WriteString("]")
+	} else {
+		b.WriteString(nilValue)
+	}
+
+	if e.Message != "" {
+		b.WriteString(" " + e.Message)
+	}
+	return b.Bytes()
+}
+
+// field returns the value of an event's numeric field if it is between min and max,
+// and def otherwise.
+func field(e *logstash.V1Event, name string, min, max, def int) int {
+	n, err := strconv.Atoi(e.Fields[name])
+	if err != nil || n < min || n > max {
+		return def
+	}
+	return n
+}
+
+// header returns s as a header field of at most max printable ASCII characters,
+// or the nil value if it is empty.
+func header(s string, max int) string {
+	s = strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > max {
+		s = s[:max]
+	}
+	if s == "" {
+		return nilValue
+	}
+	return s
+}
+
+// sdEscaper escapes the characters RFC 5424 requires escaped in PARAM-VALUEs.
+var sdEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, `]`, `\]`)
+
+// validSDName returns true for valid SD-IDs and PARAM-NAMEs: 1 to 32 printable ASCII
+// characters other than '=', ' ', ']' and '"'.
+func validSDName(s string) bool {
+	if len(s) == 0 || len(s) > 32 {
+		return false
+	}
+	for _, r := range s {
+		if r < 33 || r > 126 || r == '=' || r == ']' || r == '"' {
+			return false
+		}
+	}
+	return true
+}
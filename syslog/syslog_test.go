@@ -0,0 +1,123 @@
+package syslog
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pantheon-systems/journal-2-logstash/logstash"
+	"github.com/stretchr/testify/assert"
+)
+
+func journalEvent() *logstash.V1Event {
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 123456789, time.UTC))
+	e.Message = "Started nginx"
+	e.Fields["PRIORITY"] = "3"
+	e.Fields["SYSLOG_FACILITY"] = "3"
+	e.Fields["SYSLOG_IDENTIFIER"] = "systemd"
+	e.Fields["_PID"] = "1"
+	e.Fields["_HOSTNAME"] = "web1"
+	e.Fields["_SYSTEMD_UNIT"] = `odd"unit]\`
+	return e
+}
+
+func TestFormat(t *testing.T) {
+	c, err := NewClient(Config{Host: "default-host", Facility: DefaultFacility, StructuredDataFields: []string{"_SYSTEMD_UNIT", "__CURSOR"}})
+	assert.Nil(t, err)
+
+	assert.Equal(t,
+		`<27>1 2016-08-10T12:00:00.123456Z web1 systemd 1 - [journal@32473 _SYSTEMD_UNIT="odd\"unit\]\\"] Started nginx`,
+		string(c.format(journalEvent())))
+
+	e := logstash.NewV1Event()
+	e.SetTimestamp(time.Date(2016, 8, 10, 12, 0, 0, 0, time.UTC))
+	e.Fields["SYSLOG_IDENTIFIER"] = "my app"
+	assert.Equal(t,
+		"<14>1 2016-08-10T12:00:00.000000Z default-host my_app - - -",
+		string(c.format(e)))
+
+	// the kernel facility is 0, so it is not mistaken for an unset facility
+	kern, err := NewClient(Config{Host: "default-host"})
+	assert.Nil(t, err)
+	assert.Equal(t,
+		"<6>1 2016-08-10T12:00:00.000000Z default-host my_app - - -",
+		string(kern.format(e)))
+}
+
+func TestNewClient(t *testing.T) {
+	_, err := NewClient(Config{Facility: 24})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{SDID: "bad id"})
+	assert.NotNil(t, err)
+	_, err = NewClient(Config{StructuredDataFields: []string{"A=B"}})
+	assert.NotNil(t, err)
+}
+
+// readFrames reads octet counted messages from the first connection to l.
+func readFrames(l net.Listener, frames chan<- string) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		length, err := r.ReadString(' ')
+		if err != nil {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(length))
+		if err != nil {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return
+		}
+		frames <- string(msg)
+	}
+}
+
+func TestWrite__tls(t *testing.T) {
+	serverTLSConfig, err := logstash.NewTLSConfig("../test/fixtures/certs/logstash.key",
+		"../test/fixtures/certs/logstash.crt",
+		"../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", serverTLSConfig)
+	assert.Nil(t, err)
+	defer l.Close()
+	frames := make(chan string, 2)
+	go readFrames(l, frames)
+
+	clientTLSConfig, err := logstash.NewTLSConfig("", "", "../test/fixtures/certs/ca.crt")
+	assert.Nil(t, err)
+	// a failed handshake fails the test straight away rather than being retried
+	c, err := NewClient(Config{URL: l.Addr().String(), TLSConfig: clientTLSConfig, Timeout: time.Duration(5 * time.Second),
+		Retry: logstash.RetryPolicy{MaxAttempts: 1}})
+	assert.Nil(t, err)
+	assert.Nil(t, c.Open())
+	defer c.Close()
+
+	e := journalEvent()
+	e.Message = "line one\nline two"
+	_, err = c.Write(e)
+	assert.Nil(t, err)
+	_, err = c.Write(journalEvent())
+	assert.Nil(t, err)
+
+	for _, suffix := range []string{" line one\nline two", " Started nginx"} {
+		select {
+		case msg := <-frames:
+			assert.True(t, strings.HasPrefix(msg, "<27>1 "), msg)
+			assert.True(t, strings.HasSuffix(msg, suffix), msg)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+}
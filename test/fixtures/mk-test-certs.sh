@@ -49,9 +49,36 @@ function key_and_cert {
 			certs/$name.crt >certs/$name.pem
 }
 
+# write passphrase protected copies of a client key and cert made by key_and_cert:
+#    - certs/$name.passphrase: the passphrase
+#    - certs/$name.pkcs8.key: encrypted PKCS#8 key (PBES2, AES-256)
+#    - certs/$name.legacy.key: legacy OpenSSL PEM encrypted key
+#    - certs/$name.p12: PKCS#12 bundle of the key, cert and CA cert
+#
+function encrypted_key_and_bundle {
+	name=$1
+	echo "==> Creating encrypted copies of '$name': certs/$name.pkcs8.key, certs/$name.legacy.key, certs/$name.p12"
+	echo "correct horse battery staple" >certs/$name.passphrase
+	openssl pkcs8 -topk8 -v2 aes-256-cbc \
+		-in certs/$name.key \
+		-passout file:certs/$name.passphrase \
+		-out certs/$name.pkcs8.key
+	openssl rsa -aes256 -traditional \
+		-in certs/$name.key \
+		-passout file:certs/$name.passphrase \
+		-out certs/$name.legacy.key
+	openssl pkcs12 -export \
+		-inkey certs/$name.key \
+		-in certs/$name.crt \
+		-certfile certs/ca.crt \
+		-passout file:certs/$name.passphrase \
+		-out certs/$name.p12
+}
+
 cleanup
 create_ca
 key_and_cert "logger"
 key_and_cert "logstash"
+encrypted_key_and_bundle "logger"
 
 ls -l $(find ./certs -type f)
@@ -20,9 +20,14 @@ type Server struct {
 }
 
 // NewServer opens and returns a new Server. The caller should call Close when
-// finished to shut it down.
+// finished to shut it down. If tlsConfig is nil the Server accepts plain TCP connections.
 func NewServer(tlsConfig *tls.Config) (server *Server, err error) {
-	listener, err := tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	var listener net.Listener
+	if tlsConfig == nil {
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+	} else {
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", tlsConfig)
+	}
 	if err != nil {
 		return
 	}